@@ -0,0 +1,118 @@
+package base
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"webapp/forms"
+	"webapp/models"
+
+	"github.com/CloudyKit/jet/v6"
+)
+
+// sendActivationEmail issues a new activation token for the user and emails
+// the activation link
+func (a *Application) sendActivationEmail(user *models.Users) error {
+	token, expiry, err := a.models.Activations.New(user.ID, a.config.Security.ActivationTTL.Std())
+	if err != nil {
+		return err
+	}
+	return a.sendEmail(user.Email, "activation", map[string]interface{}{
+		"Username": user.Username,
+		"Link":     a.config.PublicURL() + "/activate?token=" + url.QueryEscape(token),
+		"Expiry":   expiry,
+	})
+}
+
+// activateHandler only shows a confirmation form: activating on GET would let
+// link scanners of mail providers burn the single-use token
+func (a *Application) activateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := make(jet.VarMap)
+	vars.Set("token", r.URL.Query().Get("token"))
+	err := a.render(w, r, "activate", vars)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) activatePostHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*2)
+
+	err := r.ParseForm()
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("token")
+	if !form.Valid() {
+		a.session.Put(r.Context(), "flash", models.ErrInvalidActivationToken.Error())
+		http.Redirect(w, r, "/activate/resend", http.StatusSeeOther)
+		return
+	}
+
+	user, err := a.models.Activations.Activate(form.Get("token"))
+	if err != nil {
+		if !errors.Is(err, models.ErrInvalidActivationToken) {
+			a.errLog.Println(err)
+			err = errors.New("Error while activating your account")
+		}
+		a.session.Put(r.Context(), "flash", err.Error())
+		http.Redirect(w, r, "/activate/resend", http.StatusSeeOther)
+		return
+	}
+	a.audit(r, auditBy(user, models.AuditActivate, "user", user.ID))
+
+	a.session.Put(r.Context(), "success", "Your account is active! You can login now.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func (a *Application) resendActivationHandler(w http.ResponseWriter, r *http.Request) {
+	err := a.render(w, r, "resend_activation", nil)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) resendActivationPostHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*2)
+
+	err := r.ParseForm()
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Email("email")
+	if !form.Valid() {
+		vars := make(jet.VarMap)
+		vars.Set("errors", form.Errors)
+		err := a.render(w, r, "resend_activation", vars)
+		if err != nil {
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+		}
+		return
+	}
+
+	user, err := a.models.Users.GetByEmail(form.Get("email"))
+	switch {
+	case err == nil && !user.Activated:
+		if err := a.sendActivationEmail(user); err != nil {
+			a.errLog.Println(err)
+		}
+	case err != nil && !errors.Is(err, models.ErrNoMoreRows):
+		a.errLog.Println(err)
+	}
+
+	// the answer is the same whether the email is known or not, so this form
+	// cannot be used to find out who has an account
+	a.session.Put(r.Context(), "success", "If that email belongs to an inactive account, a new activation link is on its way.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,305 @@
+package base
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"webapp/forms"
+	"webapp/models"
+
+	"github.com/CloudyKit/jet/v6"
+	"github.com/gorilla/mux"
+)
+
+// statsDays is how many days of signups, posts and votes the dashboard shows
+const statsDays = 14
+
+func (a *Application) adminHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := a.models.Admin.DailyStats(statsDays)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("stats", stats)
+	if err := a.render(w, r, "admin", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	filter, ok := a.adminFilters(w, r)
+	if !ok {
+		return
+	}
+	users, meta, err := a.models.Admin.ListUsers(filter)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	vars := a.adminVars(filter, meta)
+	vars.Set("users", users)
+	if err := a.render(w, r, "admin_users", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) adminPostsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, ok := a.adminFilters(w, r)
+	if !ok {
+		return
+	}
+	filter.OrderBy = "latest"
+	posts, meta, err := a.models.Posts.GetPosts(filter)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	vars := a.adminVars(filter, meta)
+	vars.Set("posts", posts)
+	if err := a.render(w, r, "admin_posts", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) adminCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, ok := a.adminFilters(w, r)
+	if !ok {
+		return
+	}
+	comments, meta, err := a.models.Admin.ListComments(filter)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	vars := a.adminVars(filter, meta)
+	vars.Set("comments", comments)
+	if err := a.render(w, r, "admin_comments", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) adminUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	role := r.PostForm.Get("role")
+	err := a.models.Users.SetRole(userID, role)
+	if err == nil {
+		e := auditOn(models.AuditUserRole, "user", userID)
+		e.Metadata = models.AuditMetadata{"role": role}
+		a.audit(r, e)
+	}
+	a.adminActionDone(w, r, err, "Role changed")
+}
+
+func (a *Application) adminUserActivationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	activated := r.PostForm.Get("activated") == "true"
+	err := a.models.Users.SetActivated(userID, activated)
+	msg, action := "User deactivated", models.AuditUserDeactivate
+	if activated {
+		msg, action = "User activated", models.AuditUserActivate
+	}
+	if err == nil {
+		a.audit(r, auditOn(action, "user", userID))
+	}
+	a.adminActionDone(w, r, err, msg)
+}
+
+func (a *Application) adminUserBanHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	form := forms.New(r.PostForm)
+	form.MaxLength("reason", 255)
+	if !form.Valid() {
+		a.session.Put(r.Context(), "flash", form.Errors.First("reason"))
+		http.Redirect(w, r, refererOr(r, "/admin/users"), http.StatusSeeOther)
+		return
+	}
+	err := a.models.Users.Ban(userID, form.Get("reason"))
+	if err == nil {
+		e := auditOn(models.AuditUserBan, "user", userID)
+		e.Metadata = models.AuditMetadata{"reason": form.Get("reason")}
+		a.audit(r, e)
+	}
+	a.adminActionDone(w, r, err, "User banned")
+}
+
+func (a *Application) adminUserUnbanHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	err := a.models.Users.Unban(userID)
+	if err == nil {
+		a.audit(r, auditOn(models.AuditUserUnban, "user", userID))
+	}
+	a.adminActionDone(w, r, err, "User unbanned")
+}
+
+// adminUserTwoFactorResetHandler turns two-factor authentication off for a
+// user who lost their authenticator app and their recovery codes
+func (a *Application) adminUserTwoFactorResetHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	err := a.models.TwoFactor.Disable(userID)
+	if err == nil {
+		a.audit(r, auditOn(models.AuditTwoFactorReset, "user", userID))
+	}
+	a.adminActionDone(w, r, err, "Two-factor authentication turned off")
+}
+
+func (a *Application) adminPostDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+	err := a.models.Posts.Remove(postID)
+	if err == nil {
+		a.audit(r, auditOn(models.AuditPostRemove, "post", postID))
+	}
+	a.adminActionDone(w, r, err, "Post deleted")
+}
+
+func (a *Application) adminPostLockHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+	locked := r.PostFormValue("locked") == "true"
+	err := a.models.Posts.SetLocked(postID, locked)
+	msg, action := "Post unlocked", models.AuditPostUnlock
+	if locked {
+		msg, action = "Post locked", models.AuditPostLock
+	}
+	if err == nil {
+		a.audit(r, auditOn(action, "post", postID))
+	}
+	a.adminActionDone(w, r, err, msg)
+}
+
+func (a *Application) adminPostTitleHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*2)
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+
+	err := r.ParseForm()
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	form := forms.New(r.PostForm)
+	form.Required("title").MaxLength("title", 100)
+	if !form.Valid() {
+		a.session.Put(r.Context(), "flash", form.Errors.First("title"))
+		http.Redirect(w, r, refererOr(r, "/admin/posts"), http.StatusSeeOther)
+		return
+	}
+
+	err = a.models.Posts.SetTitle(postID, a.currentUserID(r), form.Get("title"))
+	if err == nil {
+		e := auditOn(models.AuditPostRetitle, "post", postID)
+		e.Metadata = models.AuditMetadata{"title": form.Get("title")}
+		a.audit(r, e)
+	}
+	a.adminActionDone(w, r, err, "Title changed")
+}
+
+func (a *Application) adminCommentDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	commentID, _ := strconv.Atoi(mux.Vars(r)["commentID"])
+	err := a.models.Comments.Remove(commentID)
+	if err == nil {
+		a.audit(r, auditOn(models.AuditCommentRemove, "comment", commentID))
+	}
+	a.adminActionDone(w, r, err, "Comment deleted")
+}
+
+// adminFilters reads the page and search query of an admin table
+func (a *Application) adminFilters(w http.ResponseWriter, r *http.Request) (models.Filters, bool) {
+	filter := models.Filters{
+		Query:    r.URL.Query().Get("q"),
+		Page:     a.readIntDefault(r, "page", 1),
+		PageSize: a.readIntDefault(r, "page_size", 20),
+	}
+	if err := filter.Validate(); err != nil {
+		a.clientErr(w, http.StatusBadRequest)
+		return filter, false
+	}
+	return filter, true
+}
+
+// adminVars holds what every admin table needs to render its search box
+// and pagination
+func (a *Application) adminVars(filter models.Filters, meta models.MetaData) jet.VarMap {
+	query := url.Values{}
+	query.Set("page_size", strconv.Itoa(filter.PageSize))
+	if filter.Query != "" {
+		query.Set("q", filter.Query)
+	}
+	query.Set("page", strconv.Itoa(meta.NextPage))
+	nextURL := query.Encode()
+	query.Set("page", strconv.Itoa(meta.PrevPage))
+	prevURL := query.Encode()
+
+	vars := make(jet.VarMap)
+	vars.Set("q", filter.Query)
+	vars.Set("meta", meta)
+	vars.Set("nextUrl", nextURL)
+	vars.Set("prevUrl", prevURL)
+	return vars
+}
+
+// adminTargetUser reads the user an admin acts on. Admins can't act on
+// their own account, so they can't lock themselves out.
+func (a *Application) adminTargetUser(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, _ := strconv.Atoi(mux.Vars(r)["userID"])
+	if err := r.ParseForm(); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return 0, false
+	}
+	if userID == a.currentUserID(r) {
+		a.session.Put(r.Context(), "flash", "You can't change your own account from the admin dashboard")
+		http.Redirect(w, r, refererOr(r, "/admin/users"), http.StatusSeeOther)
+		return 0, false
+	}
+	return userID, true
+}
+
+// adminActionDone sends the admin back to the table they acted on, with msg
+// as a success message or the error when the action failed
+func (a *Application) adminActionDone(w http.ResponseWriter, r *http.Request, err error, msg string) {
+	switch {
+	case err == nil:
+		a.session.Put(r.Context(), "success", msg)
+	case errors.Is(err, models.ErrNoMoreRows):
+		a.clientErr(w, http.StatusNotFound)
+		return
+	case errors.Is(err, models.ErrInvalidRole),
+		errors.Is(err, models.ErrDuplicatePost),
+		errors.Is(err, models.ErrInvalidResolution),
+		errors.Is(err, models.ErrBanStaff):
+		a.session.Put(r.Context(), "flash", err.Error())
+	default:
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	http.Redirect(w, r, refererOr(r, "/admin"), http.StatusSeeOther)
+}
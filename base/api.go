@@ -0,0 +1,440 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"webapp/forms"
+	"webapp/models"
+
+	"github.com/gorilla/mux"
+)
+
+// apiPrefix is the path every route of the versioned JSON API lives under
+const apiPrefix = "/api/v1"
+
+func (a *Application) apiRoutes(router *mux.Router) {
+	router.Use(a.authenticateToken)
+	router.Use(a.apiJSONRequired)
+
+	router.HandleFunc("/posts", a.requireScope(models.ScopeRead, a.apiListPostsHandler)).Methods(http.MethodGet)
+	router.HandleFunc("/posts", a.apiAuthRequired(a.requireScope(models.ScopeSubmit, a.apiCreatePostHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/posts/{postID:[0-9]+}", a.requireScope(models.ScopeRead, a.apiShowPostHandler)).Methods(http.MethodGet)
+	router.HandleFunc("/posts/{postID:[0-9]+}", a.apiAuthRequired(a.requireScope(models.ScopeSubmit, a.apiUpdatePostHandler))).Methods(http.MethodPatch)
+	router.HandleFunc("/posts/{postID:[0-9]+}", a.apiAuthRequired(a.requireScope(models.ScopeSubmit, a.apiDeletePostHandler))).Methods(http.MethodDelete)
+	router.HandleFunc("/posts/{postID:[0-9]+}/vote", a.apiAuthRequired(a.requireScope(models.ScopeVote, a.apiVoteHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/comments/{commentID:[0-9]+}", a.apiAuthRequired(a.requireScope(models.ScopeComment, a.apiUpdateCommentHandler))).Methods(http.MethodPatch)
+	router.HandleFunc("/comments/{commentID:[0-9]+}", a.apiAuthRequired(a.requireScope(models.ScopeComment, a.apiDeleteCommentHandler))).Methods(http.MethodDelete)
+	router.HandleFunc("/comments/{commentID:[0-9]+}/vote", a.apiAuthRequired(a.requireScope(models.ScopeVote, a.apiCommentVoteHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/posts/{postID:[0-9]+}/comments", a.apiAuthRequired(a.requireScope(models.ScopeComment, a.apiCreateCommentHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/me", a.apiAuthRequired(a.requireScope(models.ScopeRead, a.apiMeHandler))).Methods(http.MethodGet)
+	router.HandleFunc("/users", a.apiSignupHandler).Methods(http.MethodPost)
+	router.HandleFunc("/login", a.apiLoginHandler).Methods(http.MethodPost)
+
+	// gorilla/mux subrouters report a wrong method as not found too, so this
+	// also covers e.g. GET on a POST-only route
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.errorJSON(w, http.StatusNotFound, "The requested resource could not be found")
+	})
+}
+
+func (a *Application) apiListPostsHandler(w http.ResponseWriter, r *http.Request) {
+	filter := models.Filters{
+		Query:    r.URL.Query().Get("q"),
+		Page:     a.readIntDefault(r, "page", 1),
+		PageSize: a.readIntDefault(r, "page_size", 5),
+		OrderBy:  r.URL.Query().Get("order_by"),
+		Window:   r.URL.Query().Get("t"),
+		// in=comments also matches posts by the text of their comments
+		SearchComments: r.URL.Query().Get("in") == "comments",
+	}
+	if err := filter.Validate(); err != nil {
+		a.errorJSON(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	posts, meta, err := a.models.Posts.GetPosts(filter)
+	if err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+	if err := a.setUserVotes(r, postPointers(posts)...); err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+	if posts == nil {
+		posts = []models.Posts{}
+	}
+
+	a.writeJSON(w, http.StatusOK, envelope{"posts": posts, "metadata": meta})
+}
+
+func (a *Application) apiShowPostHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+
+	post, err := a.models.Posts.GetByID(postID)
+	if err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+
+	if err := a.setUserVotes(r, post); err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+
+	comments, err := a.models.Comments.GetCommentsForPost(postID, r.URL.Query().Get("order_by"))
+	if err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+	if err := a.setCommentVotes(r, postID, comments); err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+	if comments == nil {
+		comments = []models.Comments{}
+	}
+
+	a.writeJSON(w, http.StatusOK, envelope{"post": post, "comments": comments})
+}
+
+func (a *Application) apiCreatePostHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title string `json:"title"`
+		URL   string `json:"url"`
+	}
+	if err := a.readJSON(w, r, &input); err != nil {
+		a.badRequestJSON(w, err)
+		return
+	}
+
+	form := forms.New(url.Values{"title": {input.Title}, "url": {input.URL}})
+	validateSubmitForm(form)
+	if !form.Valid() {
+		a.failedValidationJSON(w, form.Errors)
+		return
+	}
+
+	userID := a.currentUserID(r)
+	post, err := a.models.Posts.Insert(input.Title, input.URL, userID)
+	if err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/posts/%d", apiPrefix, post.ID))
+	a.writeJSON(w, http.StatusCreated, envelope{"post": post})
+}
+
+// apiUpdatePostHandler changes the fields present in the body, i.e. both
+// {"title": "..."} and {"url": "..."} are valid requests
+func (a *Application) apiUpdatePostHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+
+	post, err := a.models.Posts.GetByID(postID)
+	if err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+
+	var input struct {
+		Title *string `json:"title"`
+		URL   *string `json:"url"`
+	}
+	if err := a.readJSON(w, r, &input); err != nil {
+		a.badRequestJSON(w, err)
+		return
+	}
+	if input.Title != nil {
+		post.Title = *input.Title
+	}
+	if input.URL != nil {
+		post.URL = *input.URL
+	}
+
+	form := forms.New(url.Values{"title": {post.Title}, "url": {post.URL}})
+	validateSubmitForm(form)
+	if !form.Valid() {
+		a.failedValidationJSON(w, form.Errors)
+		return
+	}
+
+	post, err = a.models.Posts.Update(postID, a.currentUserID(r), post.Title, post.URL, a.config.Content.EditWindow.Std())
+	if err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, envelope{"post": post})
+}
+
+func (a *Application) apiDeletePostHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+
+	if err := a.models.Posts.Delete(postID, a.currentUserID(r)); err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+	a.audit(r, auditOn(models.AuditPostDelete, "post", postID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Application) apiVoteHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+
+	post, err := a.models.Posts.GetByID(postID)
+	if err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+
+	// the body is optional, {"value": -1} downvotes and {"value": 0} retracts
+	input := struct {
+		Value int `json:"value"`
+	}{Value: 1}
+	if r.ContentLength != 0 {
+		if err := a.readJSON(w, r, &input); err != nil {
+			a.badRequestJSON(w, err)
+			return
+		}
+	}
+
+	userID := a.currentUserID(r)
+	if err := a.setVote(post.ID, userID, input.Value); err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+
+	// read the post again so the response carries the new score
+	post, err = a.models.Posts.GetByID(postID)
+	if err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+	post.UserVote = input.Value
+	a.writeJSON(w, http.StatusOK, envelope{"post": post})
+}
+
+func (a *Application) apiUpdateCommentHandler(w http.ResponseWriter, r *http.Request) {
+	commentID, _ := strconv.Atoi(mux.Vars(r)["commentID"])
+
+	var input struct {
+		Body string `json:"body"`
+	}
+	if err := a.readJSON(w, r, &input); err != nil {
+		a.badRequestJSON(w, err)
+		return
+	}
+
+	form := forms.New(url.Values{"body": {input.Body}})
+	validateCommentForm(form, "body")
+	if !form.Valid() {
+		a.failedValidationJSON(w, form.Errors)
+		return
+	}
+
+	comment, err := a.models.Comments.Update(commentID, a.currentUserID(r), input.Body, a.config.Content.EditWindow.Std())
+	if err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, envelope{"comment": comment})
+}
+
+func (a *Application) apiDeleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	commentID, _ := strconv.Atoi(mux.Vars(r)["commentID"])
+
+	if _, err := a.models.Comments.Delete(commentID, a.currentUserID(r)); err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+	a.audit(r, auditOn(models.AuditCommentDelete, "comment", commentID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Application) apiCommentVoteHandler(w http.ResponseWriter, r *http.Request) {
+	commentID, _ := strconv.Atoi(mux.Vars(r)["commentID"])
+
+	comment, err := a.models.Comments.GetByID(commentID)
+	if err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+
+	// the body is optional, {"value": -1} downvotes and {"value": 0} retracts
+	input := struct {
+		Value int `json:"value"`
+	}{Value: 1}
+	if r.ContentLength != 0 {
+		if err := a.readJSON(w, r, &input); err != nil {
+			a.badRequestJSON(w, err)
+			return
+		}
+	}
+
+	userID := a.currentUserID(r)
+	if err := a.setCommentVote(comment.ID, userID, input.Value); err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+
+	comment, err = a.models.Comments.GetByID(commentID)
+	if err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+	comment.UserVote = input.Value
+	a.writeJSON(w, http.StatusOK, envelope{"comment": comment})
+}
+
+func (a *Application) apiCreateCommentHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+
+	var input struct {
+		Body     string `json:"body"`
+		ParentID int    `json:"parent_id"`
+	}
+	if err := a.readJSON(w, r, &input); err != nil {
+		a.badRequestJSON(w, err)
+		return
+	}
+
+	form := forms.New(url.Values{"body": {input.Body}})
+	validateCommentForm(form, "body")
+	if !form.Valid() {
+		a.failedValidationJSON(w, form.Errors)
+		return
+	}
+
+	if _, err := a.models.Posts.GetByID(postID); err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+
+	userID := a.currentUserID(r)
+	comment, err := a.models.Comments.Insert(input.Body, postID, userID, input.ParentID)
+	if err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+
+	a.writeJSON(w, http.StatusCreated, envelope{"comment": comment})
+}
+
+func (a *Application) apiMeHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := a.models.Users.GetByID(a.currentUserID(r))
+	if err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, envelope{"user": user})
+}
+
+func (a *Application) apiSignupHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name     string `json:"name"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := a.readJSON(w, r, &input); err != nil {
+		a.badRequestJSON(w, err)
+		return
+	}
+
+	form := forms.New(url.Values{"name": {input.Name}, "email": {input.Email}, "password": {input.Password}})
+	validateSignupForm(form)
+	if !form.Valid() {
+		a.failedValidationJSON(w, form.Errors)
+		return
+	}
+
+	user := models.Users{
+		Username:  input.Name,
+		Password:  input.Password,
+		Email:     input.Email,
+		Activated: false,
+	}
+	if err := a.models.Users.Insert(&user); err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+	a.audit(r, auditBy(&user, models.AuditSignup, "user", user.ID))
+	if err := a.sendActivationEmail(&user); err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+
+	a.writeJSON(w, http.StatusCreated, envelope{"user": user, "message": "Check your email for the link to activate the account"})
+}
+
+// apiLoginHandler logs the user in with the same cookie session the HTML
+// pages use, so API clients have to keep the session cookie
+func (a *Application) apiLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+		// Code is a two-factor code or a recovery code, for the users who
+		// turned two-factor authentication on
+		Code string `json:"code"`
+	}
+	if err := a.readJSON(w, r, &input); err != nil {
+		a.badRequestJSON(w, err)
+		return
+	}
+
+	// either the email or the username identifies the account
+	login := input.Email
+	if login == "" {
+		login = input.Username
+	}
+	form := forms.New(url.Values{"login": {login}, "password": {input.Password}})
+	validateLoginForm(form)
+	if !form.Valid() {
+		a.failedValidationJSON(w, form.Errors)
+		return
+	}
+
+	user, at, err := a.authenticate(r, login, input.Password)
+	if err != nil {
+		if isLoginError(err) {
+			a.auditLoginFailed(r, login, err)
+		}
+		a.modelErrorJSON(w, err)
+		return
+	}
+
+	// the attempt covers both factors, a wrong code counts like a wrong
+	// password
+	if user.HasTwoFactor() {
+		if input.Code == "" {
+			if err := a.refundLoginAttempt(at); err != nil {
+				a.modelErrorJSON(w, err)
+				return
+			}
+			a.modelErrorJSON(w, models.ErrTwoFactorRequired)
+			return
+		}
+		if _, err := a.models.TwoFactor.Verify(user.ID, input.Code); err != nil {
+			if errors.Is(err, models.ErrInvalidTwoFactorCode) {
+				a.audit(r, auditOn(models.AuditTwoFactorFailed, "user", user.ID))
+				a.loginFailed(r, user, login, at)
+			}
+			a.modelErrorJSON(w, err)
+			return
+		}
+	}
+	if err := a.loginSucceeded(at); err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+
+	if err := a.logIn(r, user); err != nil {
+		a.modelErrorJSON(w, err)
+		return
+	}
+	a.audit(r, auditBy(user, models.AuditLogin, "user", user.ID))
+	a.writeJSON(w, http.StatusOK, envelope{"user": user})
+}
@@ -0,0 +1,169 @@
+package base
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"webapp/models"
+
+	"github.com/CloudyKit/jet/v6"
+)
+
+// audit appends an event caused by the request to the audit log. The actor
+// defaults to the user making the request, the IP and user agent are taken
+// from the request. Failing to record an event is logged but doesn't fail
+// the request.
+func (a *Application) audit(r *http.Request, e models.AuditEvent) {
+	if e.ActorID == nil {
+		if id := a.currentUserID(r); id != 0 {
+			e.ActorID = &id
+		}
+	}
+	if e.ActorName == "" && e.ActorID != nil {
+		e.ActorName = a.usernameOf(r, *e.ActorID)
+	}
+	e.IP = clientIP(r)
+	e.UserAgent = r.UserAgent()
+
+	if err := a.models.Audit.Record(&e); err != nil {
+		a.errLog.Printf("recording audit event %s: %v", e.Action, err)
+	}
+}
+
+// auditOn returns an event with the given action and target, acted by the
+// user making the request
+func auditOn(action, targetType string, targetID int) models.AuditEvent {
+	return models.AuditEvent{Action: action, TargetType: targetType, TargetID: &targetID}
+}
+
+// auditBy is auditOn for events that happen before the user is in the
+// request context, e.g. logins and signups
+func auditBy(user *models.Users, action, targetType string, targetID int) models.AuditEvent {
+	e := auditOn(action, targetType, targetID)
+	e.ActorID = &user.ID
+	e.ActorName = user.Username
+	return e
+}
+
+// auditRestore returns the event of a moderator restoring a revision of a
+// post or comment
+func auditRestore(targetType string, targetID, revisionID int) models.AuditEvent {
+	e := auditOn(models.AuditRevisionRestore, targetType, targetID)
+	e.Metadata = models.AuditMetadata{"revision_id": revisionID}
+	return e
+}
+
+// auditLoginFailed records a failed login, the email or username that was
+// tried is kept but never the password
+func (a *Application) auditLoginFailed(r *http.Request, login string, err error) {
+	reason := "invalid_credentials"
+	switch {
+	case errors.Is(err, models.ErrUserBanned):
+		reason = "banned"
+	case errors.Is(err, models.ErrUserNotActive):
+		reason = "not_activated"
+	case errors.Is(err, models.ErrLoginThrottled):
+		reason = "throttled"
+	}
+	a.audit(r, models.AuditEvent{
+		Action:   models.AuditLoginFailed,
+		Metadata: models.AuditMetadata{"login": login, "reason": reason},
+	})
+}
+
+// usernameOf returns the username of the user, preferably without a query
+func (a *Application) usernameOf(r *http.Request, userID int) string {
+	if user := userFromContext(r); user != nil && user.ID == userID {
+		return user.Username
+	}
+	user, err := a.models.Users.GetByID(userID)
+	if err != nil {
+		return ""
+	}
+	return user.Username
+}
+
+// clientIP is the address the request came from, without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (a *Application) adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.AuditFilters{
+		Filters: models.Filters{
+			Page:     a.readIntDefault(r, "page", 1),
+			PageSize: a.readIntDefault(r, "page_size", 50),
+		},
+		Action:     query.Get("action"),
+		Actor:      strings.TrimSpace(query.Get("actor")),
+		TargetType: query.Get("target_type"),
+		TargetID:   a.readIntFromURLQuery(r, "target_id"),
+	}
+	var err error
+	if filter.Since, err = parseAuditDay(query.Get("since")); err != nil {
+		a.clientErr(w, http.StatusBadRequest)
+		return
+	}
+	// until is inclusive, the whole day is shown
+	if filter.Until, err = parseAuditDay(query.Get("until")); err != nil {
+		a.clientErr(w, http.StatusBadRequest)
+		return
+	}
+	if !filter.Until.IsZero() {
+		filter.Until = filter.Until.AddDate(0, 0, 1)
+	}
+	if err := filter.Validate(); err != nil {
+		a.clientErr(w, http.StatusBadRequest)
+		return
+	}
+
+	events, meta, err := a.models.Audit.List(filter)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	// the pagination links keep the filters
+	params := url.Values{}
+	for _, key := range []string{"action", "actor", "target_type", "target_id", "since", "until"} {
+		if v := query.Get(key); v != "" {
+			params.Set(key, v)
+		}
+	}
+	params.Set("page_size", strconv.Itoa(filter.PageSize))
+	params.Set("page", strconv.Itoa(meta.NextPage))
+	nextURL := params.Encode()
+	params.Set("page", strconv.Itoa(meta.PrevPage))
+	prevURL := params.Encode()
+
+	vars := make(jet.VarMap)
+	vars.Set("events", events)
+	vars.Set("actions", models.AuditActions)
+	vars.Set("filter", query)
+	vars.Set("meta", meta)
+	vars.Set("nextUrl", nextURL)
+	vars.Set("prevUrl", prevURL)
+	if err := a.render(w, r, "admin_audit", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+// parseAuditDay parses a date of the audit viewer, an empty date is the
+// zero time
+func parseAuditDay(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(models.AuditDateLayout, s)
+}
@@ -0,0 +1,76 @@
+package base
+
+import (
+	"regexp"
+	"strings"
+)
+
+// maxDiffCells bounds the size of the LCS table, larger texts are shown as
+// removed and added as a whole
+const maxDiffCells = 1_000_000
+
+var diffTokens = regexp.MustCompile(`\s+|[^\s]+`)
+
+// diffSegment is a run of text that is unchanged, inserted or deleted
+type diffSegment struct {
+	Op   string // Op is "equal", "insert" or "delete"
+	Text string
+}
+
+// wordDiff compares two texts word by word. Whitespace is kept as tokens of
+// its own so line breaks survive in the result.
+func wordDiff(before, after string) []diffSegment {
+	a := diffTokens.FindAllString(before, -1)
+	b := diffTokens.FindAllString(after, -1)
+	if len(a)*len(b) > maxDiffCells {
+		var segs []diffSegment
+		segs = appendSegment(segs, "delete", before)
+		return appendSegment(segs, "insert", after)
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var segs []diffSegment
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			segs = appendSegment(segs, "equal", a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			segs = appendSegment(segs, "delete", a[i])
+			i++
+		default:
+			segs = appendSegment(segs, "insert", b[j])
+			j++
+		}
+	}
+	segs = appendSegment(segs, "delete", strings.Join(a[i:], ""))
+	return appendSegment(segs, "insert", strings.Join(b[j:], ""))
+}
+
+// appendSegment adds text to the last segment when it has the same op
+func appendSegment(segs []diffSegment, op, text string) []diffSegment {
+	if text == "" {
+		return segs
+	}
+	if n := len(segs); n > 0 && segs[n-1].Op == op {
+		segs[n-1].Text += text
+		return segs
+	}
+	return append(segs, diffSegment{Op: op, Text: text})
+}
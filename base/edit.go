@@ -0,0 +1,178 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"webapp/forms"
+	"webapp/models"
+
+	"github.com/CloudyKit/jet/v6"
+	"github.com/gorilla/mux"
+)
+
+func (a *Application) editPostHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+
+	post, err := a.models.Posts.GetByID(postID)
+	if err != nil {
+		a.contentErr(w, r, err, "/")
+		return
+	}
+	if !post.CanDelete(a.currentUserID(r)) {
+		a.contentErr(w, r, models.ErrNotOwner, "/")
+		return
+	}
+	if post.IsHidden() {
+		a.contentErr(w, r, models.ErrHidden, fmt.Sprintf("/comments/%d", post.ID))
+		return
+	}
+	if !post.CanEdit(a.currentUserID(r), a.config.Content.EditWindow.Std()) {
+		a.contentErr(w, r, models.ErrEditWindowClosed, fmt.Sprintf("/comments/%d", post.ID))
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("post", post)
+	vars.Set("form", forms.New(url.Values{"title": {post.Title}, "url": {post.URL}}))
+	err = a.render(w, r, "edit_post", vars)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) editPostPostHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*2)
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+
+	err := r.ParseForm()
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	validateSubmitForm(form)
+	if form.Valid() {
+		_, err = a.models.Posts.Update(postID, a.currentUserID(r), form.Get("title"), form.Get("url"), a.config.Content.EditWindow.Std())
+		if errors.Is(err, models.ErrDuplicatePost) {
+			form.Errors.Add("title", err.Error())
+		} else if err != nil {
+			a.contentErr(w, r, err, fmt.Sprintf("/comments/%d", postID))
+			return
+		}
+	}
+	if !form.Valid() {
+		vars := make(jet.VarMap)
+		vars.Set("post", &models.Posts{ID: postID})
+		vars.Set("form", form)
+		vars.Set("errors", form.Errors)
+		err := a.render(w, r, "edit_post", vars)
+		if err != nil {
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+		}
+		return
+	}
+
+	a.session.Put(r.Context(), "success", "Post updated")
+	http.Redirect(w, r, fmt.Sprintf("/comments/%d", postID), http.StatusSeeOther)
+}
+
+func (a *Application) deletePostHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+
+	err := a.models.Posts.Delete(postID, a.currentUserID(r))
+	if err != nil {
+		a.contentErr(w, r, err, fmt.Sprintf("/comments/%d", postID))
+		return
+	}
+	a.audit(r, auditOn(models.AuditPostDelete, "post", postID))
+
+	a.session.Put(r.Context(), "success", "Post deleted")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (a *Application) editCommentPostHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*2)
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+	commentID, _ := strconv.Atoi(mux.Vars(r)["commentID"])
+	back := fmt.Sprintf("/comments/%d#comment-%d", postID, commentID)
+
+	err := r.ParseForm()
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	if !a.commentOnPost(w, r, commentID, postID) {
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	validateCommentForm(form, "comment")
+	if !form.Valid() {
+		a.session.Put(r.Context(), "flash", form.Errors.First("comment"))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	_, err = a.models.Comments.Update(commentID, a.currentUserID(r), form.Get("comment"), a.config.Content.EditWindow.Std())
+	if err != nil {
+		a.contentErr(w, r, err, back)
+		return
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+func (a *Application) deleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+	commentID, _ := strconv.Atoi(mux.Vars(r)["commentID"])
+	back := fmt.Sprintf("/comments/%d#comment-%d", postID, commentID)
+
+	if !a.commentOnPost(w, r, commentID, postID) {
+		return
+	}
+	_, err := a.models.Comments.Delete(commentID, a.currentUserID(r))
+	if err != nil {
+		a.contentErr(w, r, err, back)
+		return
+	}
+	a.audit(r, auditOn(models.AuditCommentDelete, "comment", commentID))
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// commentOnPost checks that the comment in the URL belongs to the post in
+// the URL, so a comment can't be changed through the page of another post
+func (a *Application) commentOnPost(w http.ResponseWriter, r *http.Request, commentID, postID int) bool {
+	comment, err := a.models.Comments.GetByID(commentID)
+	if err == nil && comment.PostID != postID {
+		err = models.ErrNoMoreRows
+	}
+	if err != nil {
+		a.contentErr(w, r, err, fmt.Sprintf("/comments/%d", postID))
+		return false
+	}
+	return true
+}
+
+// contentErr reports a failed edit or delete. Errors the author can act on
+// are flashed on the page at back.
+func (a *Application) contentErr(w http.ResponseWriter, r *http.Request, err error, back string) {
+	switch {
+	case errors.Is(err, models.ErrNoMoreRows):
+		a.clientErr(w, http.StatusNotFound)
+	case errors.Is(err, models.ErrNotOwner):
+		a.clientErr(w, http.StatusForbidden)
+	case errors.Is(err, models.ErrEditWindowClosed), errors.Is(err, models.ErrHidden):
+		a.session.Put(r.Context(), "flash", err.Error())
+		http.Redirect(w, r, back, http.StatusSeeOther)
+	default:
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
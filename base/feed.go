@@ -0,0 +1,353 @@
+package base
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+	"webapp/models"
+
+	"github.com/gorilla/mux"
+)
+
+// feedSize is the number of entries in a feed unless page_size says otherwise
+const feedSize = 20
+
+// feed is the format independent content of a feed, it is rendered by
+// writeRSS or writeAtom
+type feed struct {
+	Title       string
+	Description string
+	Link        string // Link is the HTML page the feed mirrors
+	Self        string // Self is the URL of the feed itself
+	Updated     time.Time
+	Items       []feedItem
+}
+
+type feedItem struct {
+	ID        string
+	Title     string
+	Link      string
+	Comments  string
+	Author    string
+	Content   string
+	Published time.Time
+	Updated   time.Time // Updated is the last edit, Published when there was none
+}
+
+// lastChange is when something created at created and maybe edited since
+// last changed
+func lastChange(created time.Time, edited *time.Time) time.Time {
+	if edited != nil && edited.After(created) {
+		return *edited
+	}
+	return created
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	AtomLink      atomLink  `xml:"atom:link"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title,omitempty"`
+	Link        string  `xml:"link"`
+	Comments    string  `xml:"comments,omitempty"`
+	Description string  `xml:"description,omitempty"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID        string       `xml:"id"`
+	Title     string       `xml:"title"`
+	Updated   string       `xml:"updated"`
+	Published string       `xml:"published"`
+	Author    atomAuthor   `xml:"author"`
+	Links     []atomLink   `xml:"link"`
+	Content   *atomContent `xml:"content,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// feedFilters reads the same q, in, order_by and t parameters as the front
+// page, plus author to follow a single user
+func (a *Application) feedFilters(r *http.Request) models.Filters {
+	filter := models.Filters{
+		Query:          r.URL.Query().Get("q"),
+		Page:           1,
+		PageSize:       a.readIntDefault(r, "page_size", feedSize),
+		OrderBy:        r.URL.Query().Get("order_by"),
+		Window:         r.URL.Query().Get("t"),
+		Author:         r.URL.Query().Get("author"),
+		SearchComments: r.URL.Query().Get("in") == "comments",
+	}
+	if filter.OrderBy == "" {
+		// feed readers only care about what is new
+		filter.OrderBy = "latest"
+	}
+	return filter
+}
+
+// postsFeed builds the feed of the posts matching the filter
+func (a *Application) postsFeed(r *http.Request, filter models.Filters) (*feed, error) {
+	posts, _, err := a.models.Posts.GetPosts(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	base := a.config.PublicURL()
+	page := url.Values{}
+	for _, key := range []string{"q", "in", "order_by", "t"} {
+		if v := r.URL.Query().Get(key); v != "" {
+			page.Set(key, v)
+		}
+	}
+
+	f := &feed{
+		Title:       a.appName,
+		Description: "The latest news on " + a.appName,
+		Link:        base + "/",
+		Self:        base + r.URL.RequestURI(),
+	}
+	switch {
+	case filter.Author != "" && filter.Query != "":
+		f.Title = fmt.Sprintf("%s: %q by %s", a.appName, filter.Query, filter.Author)
+	case filter.Author != "":
+		f.Title = fmt.Sprintf("%s: posts by %s", a.appName, filter.Author)
+	case filter.Query != "":
+		f.Title = fmt.Sprintf("%s: %q", a.appName, filter.Query)
+	}
+	if len(page) > 0 {
+		f.Link += "?" + page.Encode()
+	}
+	for _, post := range posts {
+		discussion := base + "/comments/" + strconv.Itoa(post.ID)
+		f.Items = append(f.Items, feedItem{
+			ID:        discussion,
+			Title:     post.Title,
+			Link:      post.URL,
+			Comments:  discussion,
+			Author:    post.Username,
+			Published: post.CreatedAt,
+			Updated:   lastChange(post.CreatedAt, post.EditedAt),
+		})
+		if item := f.Items[len(f.Items)-1]; item.Updated.After(f.Updated) {
+			f.Updated = item.Updated
+		}
+	}
+	return f, nil
+}
+
+func (a *Application) rssFeedHandler(w http.ResponseWriter, r *http.Request) {
+	filter := a.feedFilters(r)
+	if err := filter.Validate(); err != nil {
+		a.clientErr(w, http.StatusBadRequest)
+		return
+	}
+	f, err := a.postsFeed(r, filter)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	a.writeRSS(w, r, f)
+}
+
+func (a *Application) atomFeedHandler(w http.ResponseWriter, r *http.Request) {
+	filter := a.feedFilters(r)
+	if err := filter.Validate(); err != nil {
+		a.clientErr(w, http.StatusBadRequest)
+		return
+	}
+	f, err := a.postsFeed(r, filter)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	a.writeAtom(w, r, f)
+}
+
+// commentsFeedHandler serves the comments of a post as an Atom feed, newest first
+func (a *Application) commentsFeedHandler(w http.ResponseWriter, r *http.Request) {
+	postID, err := strconv.Atoi(mux.Vars(r)["postID"])
+	if err != nil {
+		a.clientErr(w, http.StatusBadRequest)
+		return
+	}
+	post, err := a.models.Posts.GetByID(postID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoMoreRows) {
+			a.clientErr(w, http.StatusNotFound)
+			return
+		}
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	comments, err := a.models.Comments.GetCommentsForPost(postID, "new")
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	sort.SliceStable(comments, func(i, j int) bool {
+		return comments[i].CreatedAt.After(comments[j].CreatedAt)
+	})
+	if len(comments) > 100 {
+		comments = comments[:100]
+	}
+
+	discussion := a.config.PublicURL() + "/comments/" + strconv.Itoa(post.ID)
+	f := &feed{
+		Title:   fmt.Sprintf("Comments on %q", post.Title),
+		Link:    discussion,
+		Self:    a.config.PublicURL() + r.URL.RequestURI(),
+		Updated: post.CreatedAt,
+	}
+	for _, c := range comments {
+		if c.IsRedacted() {
+			continue
+		}
+		link := fmt.Sprintf("%s#comment-%d", discussion, c.CommentID())
+		f.Items = append(f.Items, feedItem{
+			ID:        link,
+			Title:     "Comment by " + c.Username,
+			Link:      link,
+			Author:    c.Username,
+			Content:   c.Body,
+			Published: c.CreatedAt,
+			Updated:   lastChange(c.CreatedAt, c.EditedAt),
+		})
+		if item := f.Items[len(f.Items)-1]; item.Updated.After(f.Updated) {
+			f.Updated = item.Updated
+		}
+	}
+	a.writeAtom(w, r, f)
+}
+
+func (a *Application) writeRSS(w http.ResponseWriter, r *http.Request, f *feed) {
+	doc := rssFeed{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:       f.Title,
+			Link:        f.Link,
+			Description: f.Description,
+			AtomLink:    atomLink{Href: f.Self, Rel: "self", Type: "application/rss+xml"},
+		},
+	}
+	if doc.Channel.Description == "" {
+		doc.Channel.Description = f.Title
+	}
+	if !f.Updated.IsZero() {
+		doc.Channel.LastBuildDate = f.Updated.UTC().Format(time.RFC1123Z)
+	}
+	for _, item := range f.Items {
+		doc.Channel.Items = append(doc.Channel.Items, rssItem{
+			Title:       item.Title,
+			Link:        item.Link,
+			Comments:    item.Comments,
+			Description: item.Content,
+			GUID:        rssGUID{IsPermaLink: true, Value: item.ID},
+			PubDate:     item.Published.UTC().Format(time.RFC1123Z),
+		})
+	}
+	a.writeFeed(w, r, "application/rss+xml; charset=utf-8", doc)
+}
+
+func (a *Application) writeAtom(w http.ResponseWriter, r *http.Request, f *feed) {
+	doc := atomFeed{
+		ID:      f.Self,
+		Title:   f.Title,
+		Updated: f.Updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: f.Self, Rel: "self", Type: "application/atom+xml"},
+			{Href: f.Link, Rel: "alternate", Type: "text/html"},
+		},
+	}
+	for _, item := range f.Items {
+		entry := atomEntry{
+			ID:        item.ID,
+			Title:     item.Title,
+			Updated:   item.Updated.UTC().Format(time.RFC3339),
+			Published: item.Published.UTC().Format(time.RFC3339),
+			Author:    atomAuthor{Name: item.Author},
+			Links:     []atomLink{{Href: item.Link, Rel: "alternate"}},
+		}
+		if item.Comments != "" {
+			entry.Links = append(entry.Links, atomLink{Href: item.Comments, Rel: "replies", Type: "text/html"})
+		}
+		if item.Content != "" {
+			entry.Content = &atomContent{Type: "text", Value: item.Content}
+		}
+		doc.Entries = append(doc.Entries, entry)
+	}
+	a.writeFeed(w, r, "application/atom+xml; charset=utf-8", doc)
+}
+
+// writeFeed encodes the feed and serves it with an ETag, http.ServeContent
+// answers conditional requests with 304 Not Modified so feed readers don't
+// download unchanged feeds again. There is no Last-Modified header: ranked
+// orderings, edits and deletions change a feed without making any of its
+// dates newer, only the ETag tells.
+func (a *Application) writeFeed(w http.ResponseWriter, r *http.Request, contentType string, doc interface{}) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(doc); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
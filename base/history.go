@@ -0,0 +1,148 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"webapp/models"
+
+	"github.com/CloudyKit/jet/v6"
+	"github.com/gorilla/mux"
+)
+
+// revisionView is a revision with the changes from the revision before it
+type revisionView struct {
+	Rev     models.Revisions
+	Title   []diffSegment
+	URL     []diffSegment
+	Body    []diffSegment
+	Current bool // Current marks the revision matching the content as it is now
+}
+
+// revisionViews diffs every revision against the one before it and returns
+// them newest first
+func revisionViews(revisions []models.Revisions) []revisionView {
+	views := make([]revisionView, len(revisions))
+	for i, rev := range revisions {
+		prev := rev
+		if i > 0 {
+			prev = revisions[i-1]
+		}
+		views[len(revisions)-1-i] = revisionView{
+			Rev:     rev,
+			Title:   wordDiff(prev.Title, rev.Title),
+			URL:     wordDiff(prev.URL, rev.URL),
+			Body:    wordDiff(prev.Body, rev.Body),
+			Current: i == len(revisions)-1,
+		}
+	}
+	return views
+}
+
+func (a *Application) postHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+
+	post, err := a.models.Posts.GetByID(postID)
+	if err != nil {
+		a.contentErr(w, r, err, "/")
+		return
+	}
+	revisions, err := a.models.Revisions.ForPost(postID)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("kind", "post")
+	vars.Set("heading", fmt.Sprintf("History of %q", post.Title))
+	vars.Set("back", fmt.Sprintf("/comments/%d", post.ID))
+	vars.Set("restoreURL", fmt.Sprintf("/posts/%d/history/", post.ID))
+	vars.Set("revisions", revisionViews(revisions))
+	if err := a.render(w, r, "history", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) commentHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+	commentID, _ := strconv.Atoi(mux.Vars(r)["commentID"])
+
+	comment, err := a.models.Comments.GetByID(commentID)
+	// the thread shows hidden comments redacted, only moderators may read
+	// their history
+	if err == nil && (comment.PostID != postID || comment.IsHidden() && !a.isModerator(r)) {
+		err = models.ErrNoMoreRows
+	}
+	if err != nil {
+		a.contentErr(w, r, err, fmt.Sprintf("/comments/%d", postID))
+		return
+	}
+	revisions, err := a.models.Revisions.ForComment(commentID)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("kind", "comment")
+	vars.Set("heading", "History of a comment")
+	vars.Set("back", fmt.Sprintf("/comments/%d#comment-%d", postID, commentID))
+	vars.Set("restoreURL", fmt.Sprintf("/comments/%d/%d/history/", postID, commentID))
+	vars.Set("revisions", revisionViews(revisions))
+	if err := a.render(w, r, "history", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) restorePostHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+	revisionID, _ := strconv.Atoi(mux.Vars(r)["revisionID"])
+	back := fmt.Sprintf("/posts/%d/history", postID)
+
+	err := a.models.Posts.Restore(postID, revisionID, a.currentUserID(r))
+	if err != nil {
+		if errors.Is(err, models.ErrDuplicatePost) {
+			a.session.Put(r.Context(), "flash", err.Error())
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+		a.contentErr(w, r, err, back)
+		return
+	}
+	a.audit(r, auditRestore("post", postID, revisionID))
+
+	a.session.Put(r.Context(), "success", "Revision restored")
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+func (a *Application) restoreCommentHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+	commentID, _ := strconv.Atoi(mux.Vars(r)["commentID"])
+	revisionID, _ := strconv.Atoi(mux.Vars(r)["revisionID"])
+	back := fmt.Sprintf("/comments/%d/%d/history", postID, commentID)
+
+	if !a.commentOnPost(w, r, commentID, postID) {
+		return
+	}
+	err := a.models.Comments.Restore(commentID, revisionID, a.currentUserID(r))
+	if err != nil {
+		a.contentErr(w, r, err, back)
+		return
+	}
+	a.audit(r, auditRestore("comment", commentID, revisionID))
+
+	a.session.Put(r.Context(), "success", "Revision restored")
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// isModerator reports whether the logged in user is a moderator or an admin
+func (a *Application) isModerator(r *http.Request) bool {
+	user := userFromContext(r)
+	return user != nil && user.HasRole(models.RoleModerator)
+}
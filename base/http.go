@@ -1,9 +1,13 @@
 package base
 
 import (
+	"errors"
+	"expvar"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"webapp/forms"
 	"webapp/models"
 	"webapp/public"
@@ -13,31 +17,110 @@ import (
 )
 
 const (
-	sessionKeyUserID   = "userID"
-	sessionKeyUsername = "username"
+	sessionKeyUserID         = "userID"
+	sessionKeyUsername       = "username"
+	sessionKeySessionVersion = "sessionVersion"
+	// sessionKeySessionID is the ID of the user_sessions row of the session
+	sessionKeySessionID = "sessionID"
+	// the user who entered their password but not their two-factor code yet
+	// and when they did
+	sessionKeyTwoFactorUserID  = "twoFactorUserID"
+	sessionKeyTwoFactorStarted = "twoFactorStarted"
+)
+
+type contextKey string
+
+const (
+	contextKeyAPIToken = contextKey("apiToken")
+	contextKeyUser     = contextKey("user")
 )
 
 // MakeHTTPHandler creates and returns the gin default router
 func MakeHTTPHandler(app *Application) http.Handler {
 	router := mux.NewRouter()
+	router.Use(app.realIP)
 	if app.debug {
 		router.Use(loggingMiddleware)
 	}
 	router.Use(app.csrfTokenRequired)
 	router.Use(app.loadSession)
+	router.Use(app.authenticateSession)
+
+	app.apiRoutes(router.PathPrefix(apiPrefix).Subrouter())
 
 	// routes
 	router.HandleFunc("/", app.homeHandler).Methods(http.MethodGet)
+	router.HandleFunc("/feed.rss", app.rssFeedHandler).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc("/feed.atom", app.atomFeedHandler).Methods(http.MethodGet, http.MethodHead)
 	router.HandleFunc("/comments/{postID}", app.commentHandler).Methods(http.MethodGet)
+	router.HandleFunc("/comments/{postID}/feed", app.commentsFeedHandler).Methods(http.MethodGet, http.MethodHead)
 	router.HandleFunc("/login", app.loginHandler).Methods(http.MethodGet)
 	router.HandleFunc("/login", app.loginPostHandler).Methods(http.MethodPost)
+	router.HandleFunc("/login/2fa", app.twoFactorLoginHandler).Methods(http.MethodGet)
+	router.HandleFunc("/login/2fa", app.twoFactorLoginPostHandler).Methods(http.MethodPost)
 	router.HandleFunc("/signup", app.signupHandler).Methods(http.MethodGet)
 	router.HandleFunc("/signup", app.signupPostHandler).Methods(http.MethodPost)
 	router.HandleFunc("/logout", app.authRequired(app.logoutHandler)).Methods(http.MethodGet)
-	router.HandleFunc("/vote", app.authRequired(app.voteHandler)).Methods(http.MethodGet)
+	router.HandleFunc("/activate", app.activateHandler).Methods(http.MethodGet)
+	router.HandleFunc("/activate", app.activatePostHandler).Methods(http.MethodPost)
+	router.HandleFunc("/activate/resend", app.resendActivationHandler).Methods(http.MethodGet)
+	router.HandleFunc("/activate/resend", app.resendActivationPostHandler).Methods(http.MethodPost)
+	router.HandleFunc("/password/forgot", app.forgotPasswordHandler).Methods(http.MethodGet)
+	router.HandleFunc("/password/forgot", app.forgotPasswordPostHandler).Methods(http.MethodPost)
+	router.HandleFunc("/password/reset", app.resetPasswordHandler).Methods(http.MethodGet)
+	router.HandleFunc("/password/reset", app.resetPasswordPostHandler).Methods(http.MethodPost)
+	router.HandleFunc("/vote", app.authRequired(app.voteHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/vote/comment", app.authRequired(app.commentVoteHandler)).Methods(http.MethodPost)
 	router.HandleFunc("/submit", app.authRequired(app.submitHandler)).Methods(http.MethodGet)
 	router.HandleFunc("/submit", app.authRequired(app.submitPostHandler)).Methods(http.MethodPost)
 	router.HandleFunc("/comments/{postID}", app.authRequired(app.commentPostHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/comments/{postID:[0-9]+}/{commentID:[0-9]+}/edit", app.authRequired(app.editCommentPostHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/comments/{postID:[0-9]+}/{commentID:[0-9]+}/delete", app.authRequired(app.deleteCommentHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/posts/{postID:[0-9]+}/edit", app.authRequired(app.editPostHandler)).Methods(http.MethodGet)
+	router.HandleFunc("/posts/{postID:[0-9]+}/edit", app.authRequired(app.editPostPostHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/posts/{postID:[0-9]+}/delete", app.authRequired(app.deletePostHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/posts/{postID:[0-9]+}/report", app.authRequired(app.reportPostHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/comments/{postID:[0-9]+}/{commentID:[0-9]+}/report", app.authRequired(app.reportCommentHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/posts/{postID:[0-9]+}/history", app.postHistoryHandler).Methods(http.MethodGet)
+	router.HandleFunc("/posts/{postID:[0-9]+}/history/{revisionID:[0-9]+}/restore", app.authRequired(app.requireRole(models.RoleModerator, app.restorePostHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/comments/{postID:[0-9]+}/{commentID:[0-9]+}/history", app.commentHistoryHandler).Methods(http.MethodGet)
+	router.HandleFunc("/comments/{postID:[0-9]+}/{commentID:[0-9]+}/history/{revisionID:[0-9]+}/restore", app.authRequired(app.requireRole(models.RoleModerator, app.restoreCommentHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/user/{username}", app.profileHandler).Methods(http.MethodGet)
+	router.HandleFunc("/user/{username}/about", app.authRequired(app.profileAboutHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/settings", app.authRequired(app.settingsHandler)).Methods(http.MethodGet)
+	router.HandleFunc("/settings/password", app.authRequired(app.changePasswordHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/settings/email", app.authRequired(app.changeEmailHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/settings/email/confirm", app.confirmEmailHandler).Methods(http.MethodGet)
+	router.HandleFunc("/settings/email/confirm", app.confirmEmailPostHandler).Methods(http.MethodPost)
+	router.HandleFunc("/settings/username", app.authRequired(app.changeUsernameHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/settings/2fa", app.authRequired(app.twoFactorSetupHandler)).Methods(http.MethodGet)
+	router.HandleFunc("/settings/2fa", app.authRequired(app.twoFactorEnableHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/settings/2fa/disable", app.authRequired(app.twoFactorDisableHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/settings/2fa/recovery-codes", app.authRequired(app.recoveryCodesHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/settings/sessions", app.authRequired(app.sessionsHandler)).Methods(http.MethodGet)
+	router.HandleFunc("/settings/sessions/revoke-others", app.authRequired(app.revokeOtherSessionsHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/settings/sessions/{sessionID:[0-9]+}/revoke", app.authRequired(app.revokeSessionHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/settings/tokens", app.authRequired(app.tokensHandler)).Methods(http.MethodGet)
+	router.HandleFunc("/settings/tokens", app.authRequired(app.tokensPostHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/settings/tokens/{tokenID:[0-9]+}/revoke", app.authRequired(app.revokeTokenHandler)).Methods(http.MethodPost)
+	router.HandleFunc("/admin", app.authRequired(app.requireRole(models.RoleModerator, app.adminHandler))).Methods(http.MethodGet)
+	router.HandleFunc("/admin/posts", app.authRequired(app.requireRole(models.RoleModerator, app.adminPostsHandler))).Methods(http.MethodGet)
+	router.HandleFunc("/admin/posts/{postID:[0-9]+}/delete", app.authRequired(app.requireRole(models.RoleModerator, app.adminPostDeleteHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/posts/{postID:[0-9]+}/lock", app.authRequired(app.requireRole(models.RoleModerator, app.adminPostLockHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/posts/{postID:[0-9]+}/title", app.authRequired(app.requireRole(models.RoleModerator, app.adminPostTitleHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/comments", app.authRequired(app.requireRole(models.RoleModerator, app.adminCommentsHandler))).Methods(http.MethodGet)
+	router.HandleFunc("/admin/comments/{commentID:[0-9]+}/delete", app.authRequired(app.requireRole(models.RoleModerator, app.adminCommentDeleteHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/reports", app.authRequired(app.requireRole(models.RoleModerator, app.adminReportsHandler))).Methods(http.MethodGet)
+	router.HandleFunc("/admin/reports/posts/{postID:[0-9]+}/resolve", app.authRequired(app.requireRole(models.RoleModerator, app.resolvePostReportsHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/reports/comments/{commentID:[0-9]+}/resolve", app.authRequired(app.requireRole(models.RoleModerator, app.resolveCommentReportsHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/users", app.authRequired(app.requireRole(models.RoleAdmin, app.adminUsersHandler))).Methods(http.MethodGet)
+	router.HandleFunc("/admin/users/{userID:[0-9]+}/role", app.authRequired(app.requireRole(models.RoleAdmin, app.adminUserRoleHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/users/{userID:[0-9]+}/activation", app.authRequired(app.requireRole(models.RoleAdmin, app.adminUserActivationHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/users/{userID:[0-9]+}/ban", app.authRequired(app.requireRole(models.RoleAdmin, app.adminUserBanHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/users/{userID:[0-9]+}/unban", app.authRequired(app.requireRole(models.RoleAdmin, app.adminUserUnbanHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/users/{userID:[0-9]+}/2fa/reset", app.authRequired(app.requireRole(models.RoleAdmin, app.adminUserTwoFactorResetHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/admin/audit", app.authRequired(app.requireRole(models.RoleAdmin, app.adminAuditHandler))).Methods(http.MethodGet)
+	router.HandleFunc("/admin/metrics", app.authRequired(app.requireRole(models.RoleAdmin, expvar.Handler().ServeHTTP))).Methods(http.MethodGet)
 
 	// exposing css and images via /public path which is referenced by html pages
 	fileServer := http.FileServer(http.FS(public.Files))
@@ -70,6 +153,13 @@ func (a *Application) homeHandler(w http.ResponseWriter, r *http.Request) {
 		Page:     a.readIntDefault(r, "page", 1),
 		PageSize: a.readIntDefault(r, "page_size", 5),
 		OrderBy:  r.URL.Query().Get("order_by"),
+		Window:   r.URL.Query().Get("t"),
+		// in=comments also matches posts by the text of their comments
+		SearchComments: r.URL.Query().Get("in") == "comments",
+	}
+	if filter.OrderBy == "" {
+		// the front page shows what is popular right now
+		filter.OrderBy = "hot"
 	}
 
 	posts, meta, err := a.models.Posts.GetPosts(filter)
@@ -78,10 +168,26 @@ func (a *Application) homeHandler(w http.ResponseWriter, r *http.Request) {
 		a.serverErr(w, err)
 		return
 	}
+	if err := a.setUserVotes(r, postPointers(posts)...); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
 
-	queryURL := fmt.Sprintf("page_size=%d&order_by=%s&q=%s", meta.PageSize, filter.OrderBy, filter.Query)
-	nextURL := fmt.Sprintf("%s&page=%d", queryURL, meta.NextPage)
-	prevURL := fmt.Sprintf("%s&page=%d", queryURL, meta.PrevPage)
+	query := url.Values{}
+	query.Set("page_size", strconv.Itoa(meta.PageSize))
+	query.Set("order_by", filter.OrderBy)
+	query.Set("q", filter.Query)
+	if filter.Window != "" {
+		query.Set("t", filter.Window)
+	}
+	if filter.SearchComments {
+		query.Set("in", "comments")
+	}
+	query.Set("page", strconv.Itoa(meta.NextPage))
+	nextURL := query.Encode()
+	query.Set("page", strconv.Itoa(meta.PrevPage))
+	prevURL := query.Encode()
 
 	vars := make(jet.VarMap)
 	vars.Set("posts", posts)
@@ -110,20 +216,41 @@ func (a *Application) commentHandler(w http.ResponseWriter, r *http.Request) {
 
 	post, err := a.models.Posts.GetByID(postID)
 	if err != nil {
+		if errors.Is(err, models.ErrNoMoreRows) {
+			a.clientErr(w, http.StatusNotFound)
+			return
+		}
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	if err := a.setUserVotes(r, post); err != nil {
 		a.errLog.Println(err)
 		a.serverErr(w, err)
 		return
 	}
 
-	comments, err := a.models.Comments.GetCommentsForPost(postID)
+	orderBy := r.URL.Query().Get("order_by")
+	if orderBy == "" {
+		orderBy = "best"
+	}
+	comments, err := a.models.Comments.GetCommentsForPost(postID, orderBy)
 	if err != nil {
 		a.errLog.Println(err)
 		a.serverErr(w, err)
 		return
 	}
+	if err := a.setCommentVotes(r, postID, comments); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
 
 	vars.Set("post", post)
 	vars.Set("comments", comments)
+	vars.Set("orderBy", orderBy)
+	vars.Set("reportReasons", models.ReportReasons)
 
 	err = a.render(w, r, "comments", vars)
 	if err != nil {
@@ -150,11 +277,11 @@ func (a *Application) commentPostHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	userID := a.session.GetInt(r.Context(), sessionKeyUserID)
+	userID := a.currentUserID(r)
 
 	form := forms.New(r.PostForm)
 
-	form.Required("comment").MaxLength("comment", 1000)
+	validateCommentForm(form, "comment")
 	if !form.Valid() {
 		a.errLog.Println(form.Errors)
 		a.session.Put(r.Context(), "flash", form.Errors.First("comment"))
@@ -162,10 +289,14 @@ func (a *Application) commentPostHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = a.models.Comments.Insert(form.Get("comment"), posdtID, userID)
+	_, err = a.models.Comments.Insert(form.Get("comment"), posdtID, userID, form.GetInt("parent_id"))
 	if err != nil {
-		a.errLog.Println(form.Errors)
-		a.session.Put(r.Context(), "flash", "Error while commenting on the post")
+		a.errLog.Println(err)
+		msg := "Error while commenting on the post"
+		if errors.Is(err, models.ErrInvalidParent) || errors.Is(err, models.ErrPostLocked) {
+			msg = err.Error()
+		}
+		a.session.Put(r.Context(), "flash", msg)
 		http.Redirect(w, r, fmt.Sprintf("/comments/%d", posdtID), http.StatusSeeOther)
 		return
 	}
@@ -203,9 +334,7 @@ func (a *Application) loginPostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	form := forms.New(r.PostForm)
-	form.Email("email")
-	form.MinLength("password", 3)
-	form.MaxLength("password", 16)
+	validateLoginForm(form)
 
 	if !form.Valid() {
 		// if there are form errors, render these errors in UI
@@ -215,31 +344,109 @@ func (a *Application) loginPostHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			a.errLog.Println(err)
 			a.serverErr(w, err)
-			return
 		}
+		return
 	}
 
 	// if no form errors, login the user
-	user, err := a.models.Users.AuthenticateUser(form.Get("email"), form.Get("password"))
+	user, at, err := a.authenticate(r, form.Get("login"), form.Get("password"))
 	if err != nil {
+		if !isLoginError(err) {
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+			return
+		}
+		a.auditLoginFailed(r, form.Get("login"), err)
 		a.session.Put(r.Context(), "flash", "Login error: "+err.Error())
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	a.session.RenewToken(r.Context()) // create a fresh session for this newly logged in user
+	// with two-factor authentication the user is only logged in once they
+	// entered their code too, which is counted as an attempt of its own
+	if user.HasTwoFactor() {
+		if err := a.refundLoginAttempt(at); err != nil {
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+			return
+		}
+		if err := a.startTwoFactorLogin(r, user); err != nil {
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+			return
+		}
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	if err := a.loginSucceeded(at); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	err = a.logIn(r, user)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	a.audit(r, auditBy(user, models.AuditLogin, "user", user.ID))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// logIn stores the authenticated user in a fresh session and records it in
+// the sessions of the user. Callers end the login attempt with
+// loginSucceeded first.
+func (a *Application) logIn(r *http.Request, user *models.Users) error {
+	if err := a.refreshSession(r, user); err != nil {
+		return err
+	}
+	return a.trackSession(r, user.ID)
+}
+
+// refreshSession renews the token of the session and stores the user in it
+// again, after their username or session version changed
+func (a *Application) refreshSession(r *http.Request, user *models.Users) error {
+	err := a.session.RenewToken(r.Context())
+	if err != nil {
+		return err
+	}
 	a.session.Put(r.Context(), sessionKeyUserID, user.ID)
 	a.session.Put(r.Context(), sessionKeyUsername, user.Username)
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	a.session.Put(r.Context(), sessionKeySessionVersion, user.SessionVersion)
+	return nil
+}
+
+// trackSession records the current session in the sessions of the user
+func (a *Application) trackSession(r *http.Request, userID int) error {
+	s, err := a.models.Sessions.Create(userID, clientIP(r), r.UserAgent(), a.session.Lifetime)
+	if err != nil {
+		return err
+	}
+	a.session.Put(r.Context(), sessionKeySessionID, s.ID)
+	return nil
 }
 
 func (a *Application) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	a.audit(r, models.AuditEvent{Action: models.AuditLogout})
+	a.logOut(r)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (a *Application) logOut(r *http.Request) {
+	if id := a.session.GetInt(r.Context(), sessionKeySessionID); id != 0 {
+		err := a.models.Sessions.Revoke(id, a.session.GetInt(r.Context(), sessionKeyUserID))
+		if err != nil && !errors.Is(err, models.ErrNoMoreRows) {
+			a.errLog.Println(err)
+		}
+	}
+	a.session.Remove(r.Context(), sessionKeySessionID)
 	a.session.Remove(r.Context(), sessionKeyUserID)
 	a.session.Remove(r.Context(), sessionKeyUsername)
+	a.session.Remove(r.Context(), sessionKeySessionVersion)
+	a.clearTwoFactorLogin(r)
 	a.session.Destroy(r.Context())
 	a.session.RenewToken(r.Context())
-
-	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func (a *Application) signupPostHandler(w http.ResponseWriter, r *http.Request) {
@@ -256,7 +463,7 @@ func (a *Application) signupPostHandler(w http.ResponseWriter, r *http.Request)
 	vars := make(jet.VarMap)
 	vars.Set("form", form)
 
-	form.Required("name", "email", "password").Email("email")
+	validateSignupForm(form)
 
 	if !form.Valid() {
 		vars.Set("errors", form.Errors)
@@ -269,17 +476,24 @@ func (a *Application) signupPostHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// add a new user account
+	// add a new user account, it stays inactive until the emailed link is opened
 	user := models.Users{
 		Username:  form.Get("name"),
 		Password:  form.Get("password"),
 		Email:     form.Get("email"),
-		Activated: true, // TODO: static for now, can be made dynamic by activating account only after email confirmation
+		Activated: false,
 	}
 	err = a.models.Users.Insert(&user)
 	if err != nil {
-		a.errLog.Println(err)
-		form.Fail("signup", fmt.Sprintf("Failed to create a new user account for the user %s", form.Get("name")))
+		switch {
+		case errors.Is(err, models.ErrDuplicateUsername):
+			form.Fail("name", err.Error())
+		case errors.Is(err, models.ErrDuplicateEmail):
+			form.Fail("email", err.Error())
+		default:
+			a.errLog.Println(err)
+			form.Fail("signup", fmt.Sprintf("Failed to create a new user account for the user %s", form.Get("name")))
+		}
 		vars.Set("errors", form.Errors)
 		err := a.render(w, r, "signup", vars)
 		if err != nil {
@@ -287,37 +501,158 @@ func (a *Application) signupPostHandler(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
+	a.audit(r, auditBy(&user, models.AuditSignup, "user", user.ID))
+
+	err = a.sendActivationEmail(&user)
+	if err != nil {
+		a.errLog.Println(err)
+		a.session.Put(r.Context(), "flash", "Account created, but we could not send the activation email. Please request a new one.")
+		http.Redirect(w, r, "/activate/resend", http.StatusSeeOther)
+		return
+	}
 
-	a.session.Put(r.Context(), "success", "Account created successfully! You can login now.")
+	a.session.Put(r.Context(), "success", "Account created successfully! Check your email for the link to activate it.")
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
+// voteHandler sets the vote of the current user on a post to the submitted
+// value, so repeating a request doesn't change the outcome. Requests sent by
+// vote.js get the updated vote box back as an HTML fragment, requests that
+// accept JSON get the post, and plain form posts are redirected back.
 func (a *Application) voteHandler(w http.ResponseWriter, r *http.Request) {
-	id := a.readIntDefault(r, "id", 0)
+	id, value, ok := a.readVoteForm(w, r)
+	if !ok {
+		return
+	}
 
+	// this gives the ID of user currently logged in
+	userID := a.currentUserID(r)
 	post, err := a.models.Posts.GetByID(id)
+	if err == nil {
+		err = a.setVote(post.ID, userID, value)
+	}
+	if err == nil {
+		// read the post again so the response carries the new score
+		post, err = a.models.Posts.GetByID(id)
+	}
 	if err != nil {
-		a.errLog.Println(err)
-		a.session.Put(r.Context(), "flash", "Error while voting "+err.Error())
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		a.voteFailed(w, r, err)
 		return
 	}
+	post.UserVote = value
+	a.voteSucceeded(w, r, value, "post", post)
+}
 
-	// this gives the ID of user currently logged in
-	userID := a.session.GetInt(r.Context(), sessionKeyUserID)
-	err = a.models.Posts.AddVote(post.ID, userID)
+// commentVoteHandler is voteHandler for comments
+func (a *Application) commentVoteHandler(w http.ResponseWriter, r *http.Request) {
+	id, value, ok := a.readVoteForm(w, r)
+	if !ok {
+		return
+	}
+
+	userID := a.currentUserID(r)
+	comment, err := a.models.Comments.GetByID(id)
+	if err == nil {
+		err = a.setCommentVote(comment.ID, userID, value)
+	}
+	if err == nil {
+		comment, err = a.models.Comments.GetByID(id)
+	}
+	if err != nil {
+		a.voteFailed(w, r, err)
+		return
+	}
+	comment.UserVote = value
+	a.voteSucceeded(w, r, value, "comment", comment)
+}
+
+// readVoteForm reads the id and value fields of a vote form
+func (a *Application) readVoteForm(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		a.errLog.Println(err)
+		a.clientErr(w, http.StatusBadRequest)
+		return 0, 0, false
+	}
+	id, err := strconv.Atoi(r.PostForm.Get("id"))
 	if err != nil {
+		a.clientErr(w, http.StatusBadRequest)
+		return 0, 0, false
+	}
+	value, err := strconv.Atoi(r.PostForm.Get("value"))
+	if err != nil {
+		a.clientErr(w, http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return id, value, true
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// wantsFragment reports requests sent by vote.js
+func wantsFragment(r *http.Request) bool {
+	return r.Header.Get("X-Requested-With") != ""
+}
+
+// voteFailed tells the user why their vote was refused, errors that aren't
+// about the vote itself are server errors
+func (a *Application) voteFailed(w http.ResponseWriter, r *http.Request, err error) {
+	if wantsJSON(r) {
+		a.modelErrorJSON(w, err)
+		return
+	}
+	status, ok := modelErrorStatus(err)
+	if !ok {
 		a.errLog.Println(err)
-		a.session.Put(r.Context(), "flash", "Error while voting. "+err.Error()+".")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		a.serverErr(w, err)
 		return
 	}
+	if wantsFragment(r) {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	a.session.Put(r.Context(), "flash", "Error while voting. "+err.Error()+".")
+	http.Redirect(w, r, voteRedirectTarget(r), http.StatusSeeOther)
+}
 
-	flashMsg := a.session.GetString(r.Context(), "flash")
-	if flashMsg == "" {
-		a.session.Put(r.Context(), "success", "Voted successfully!")
+// voteSucceeded responds with the voted post or comment, which is rendered
+// by the view of the same name for fragment requests
+func (a *Application) voteSucceeded(w http.ResponseWriter, r *http.Request, value int, name string, target interface{}) {
+	switch {
+	case wantsJSON(r):
+		a.writeJSON(w, http.StatusOK, envelope{name: target})
+	case wantsFragment(r):
+		vars := make(jet.VarMap)
+		vars.Set(name, target)
+		if err := a.render(w, r, name+"_vote", vars); err != nil {
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+		}
+	default:
+		if value == 0 {
+			a.session.Put(r.Context(), "success", "Vote removed")
+		} else {
+			a.session.Put(r.Context(), "success", "Voted successfully!")
+		}
+		http.Redirect(w, r, voteRedirectTarget(r), http.StatusSeeOther)
 	}
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// voteRedirectTarget sends a voter back to the page they voted on
+func voteRedirectTarget(r *http.Request) string {
+	return refererOr(r, "/")
+}
+
+// refererOr returns the page the request came from as long as it is a page
+// of this site, fallback otherwise
+func refererOr(r *http.Request, fallback string) string {
+	ref, err := url.Parse(r.Referer())
+	if err != nil || ref.Host != r.Host || !strings.HasPrefix(ref.Path, "/") || strings.HasPrefix(ref.Path, "//") {
+		return fallback
+	}
+	return ref.RequestURI()
 }
 
 // Get method is to just get the submit form for the user to enter title and url
@@ -344,10 +679,10 @@ func (a *Application) submitPostHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	form := forms.New(r.PostForm)
-	userID := a.session.GetInt(r.Context(), sessionKeyUserID)
+	userID := a.currentUserID(r)
 	vars := make(jet.VarMap)
 
-	form.Required("title", "url").URL("url").MaxLength("title", 100).MaxLength("url", 255)
+	validateSubmitForm(form)
 	vars.Set("form", form)
 	if !form.Valid() {
 		vars.Set("errors", form.Errors)
@@ -373,3 +708,24 @@ func (a *Application) submitPostHandler(w http.ResponseWriter, r *http.Request)
 	a.session.Put(r.Context(), "success", "Post submitted successfully!")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
+
+// The validators below are shared by the HTML and the JSON API handlers
+
+func validateCommentForm(form *forms.Form, field string) {
+	form.Required(field).MaxLength(field, 1000)
+}
+
+// validateLoginForm checks the login form, login is an email or a username
+func validateLoginForm(form *forms.Form) {
+	form.Required("login")
+	form.MinLength("password", 3)
+	form.MaxLength("password", 16)
+}
+
+func validateSignupForm(form *forms.Form) {
+	form.Required("name", "email", "password").Username("name").Email("email")
+}
+
+func validateSubmitForm(form *forms.Form) {
+	form.Required("title", "url").URL("url").MaxLength("title", 100).MaxLength("url", 255)
+}
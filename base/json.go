@@ -0,0 +1,145 @@
+package base
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"webapp/models"
+)
+
+// envelope is the top level object of every JSON API response
+type envelope map[string]interface{}
+
+// apiError is the body of the "error" key in a JSON error response
+type apiError struct {
+	Status  int                 `json:"status"`
+	Message string              `json:"message"`
+	Fields  map[string][]string `json:"fields,omitempty"`
+}
+
+var errUnsupportedMediaType = errors.New("Content-Type must be application/json")
+
+func (a *Application) writeJSON(w http.ResponseWriter, status int, data envelope) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		a.errLog.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(js, '\n'))
+}
+
+// readJSON decodes a single JSON object from the request body into dst.
+// Requests must declare a JSON content type, which browsers cannot send
+// cross-origin without a CORS preflight; this is what keeps the API safe
+// from CSRF even though it is exempt from the nosurf token check.
+func (a *Application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return errUnsupportedMediaType
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*2)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxErr.Offset)
+		case errors.As(err, &typeErr):
+			return fmt.Errorf("body contains an invalid value for the %q field", typeErr.Field)
+		case errors.As(err, &maxBytesErr):
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytesErr.Limit)
+		case errors.Is(err, io.EOF):
+			return errors.New("body must not be empty")
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			return fmt.Errorf("body contains unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+		default:
+			return err
+		}
+	}
+	if dec.More() {
+		return errors.New("body must only contain a single JSON object")
+	}
+	return nil
+}
+
+func (a *Application) errorJSON(w http.ResponseWriter, status int, message string) {
+	a.writeJSON(w, status, envelope{"error": apiError{Status: status, Message: message}})
+}
+
+// badRequestJSON reports a body that could not be read by readJSON
+func (a *Application) badRequestJSON(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnsupportedMediaType) {
+		a.errorJSON(w, http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+	a.errorJSON(w, http.StatusBadRequest, err.Error())
+}
+
+func (a *Application) failedValidationJSON(w http.ResponseWriter, fields map[string][]string) {
+	status := http.StatusUnprocessableEntity
+	a.writeJSON(w, status, envelope{"error": apiError{
+		Status:  status,
+		Message: "The request contains invalid fields",
+		Fields:  fields,
+	}})
+}
+
+// modelErrorJSON maps the sentinel errors of the models package to HTTP
+// statuses. Anything unknown is logged and reported as a server error.
+func (a *Application) modelErrorJSON(w http.ResponseWriter, err error) {
+	status, ok := modelErrorStatus(err)
+	if !ok {
+		a.errLog.Output(2, err.Error())
+		a.errorJSON(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	a.errorJSON(w, status, err.Error())
+}
+
+// modelErrorStatus returns the status of an error of the models whose
+// message may be shown to the user, ok is false for any other error
+func modelErrorStatus(err error) (status int, ok bool) {
+	switch {
+	case errors.Is(err, models.ErrNoMoreRows):
+		status = http.StatusNotFound
+	case errors.Is(err, models.ErrDuplicateVote),
+		errors.Is(err, models.ErrDuplicatePost),
+		errors.Is(err, models.ErrDuplicateTitle),
+		errors.Is(err, models.ErrDuplicateEmail),
+		errors.Is(err, models.ErrDuplicateUsername):
+		status = http.StatusConflict
+	case errors.Is(err, models.ErrInvalidLogin),
+		errors.Is(err, models.ErrTwoFactorRequired),
+		errors.Is(err, models.ErrInvalidTwoFactorCode):
+		status = http.StatusUnauthorized
+	case errors.Is(err, models.ErrUserNotActive),
+		errors.Is(err, models.ErrUserBanned),
+		errors.Is(err, models.ErrPostLocked),
+		errors.Is(err, models.ErrNotEnoughKarma),
+		errors.Is(err, models.ErrNotOwner),
+		errors.Is(err, models.ErrEditWindowClosed),
+		errors.Is(err, models.ErrHidden):
+		status = http.StatusForbidden
+	case errors.Is(err, models.ErrInvalidParent),
+		errors.Is(err, models.ErrInvalidScope),
+		errors.Is(err, models.ErrInvalidVote):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, models.ErrLoginThrottled),
+		errors.Is(err, models.ErrTooManyTwoFactorCodes):
+		status = http.StatusTooManyRequests
+	default:
+		return 0, false
+	}
+	return status, true
+}
@@ -0,0 +1,227 @@
+package base
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"webapp/models"
+)
+
+// loginMetrics counts the failed logins and what throttling did about them,
+// admins read them at /admin/metrics along with the other expvar variables
+var loginMetrics = expvar.NewMap("logins")
+
+// Keys of loginMetrics
+const (
+	metricLoginFailed    = "failed"
+	metricLoginThrottled = "throttled"
+	metricLockouts       = "account_lockouts"
+	metricIPBackoffs     = "ip_backoffs"
+)
+
+// accountLoginPolicy throttles the failed logins of an account, or of a
+// login that matches no account
+func (a *Application) accountLoginPolicy() models.LoginPolicy {
+	c := a.config.Login
+	return models.LoginPolicy{
+		FreeAttempts:    c.FreeAttempts,
+		BackoffBase:     c.BackoffBase.Std(),
+		BackoffMax:      c.BackoffMax.Std(),
+		Window:          c.FailureWindow.Std(),
+		LockoutAttempts: c.LockoutAttempts,
+		LockoutDuration: c.LockoutDuration.Std(),
+	}
+}
+
+// ipLoginPolicy throttles the failed logins from an IP address, which may
+// be shared by many users so it is never locked out
+func (a *Application) ipLoginPolicy() models.LoginPolicy {
+	c := a.config.Login
+	return models.LoginPolicy{
+		FreeAttempts: c.IPFreeAttempts,
+		BackoffBase:  c.BackoffBase.Std(),
+		BackoffMax:   c.BackoffMax.Std(),
+		Window:       c.FailureWindow.Std(),
+	}
+}
+
+// loginAccountKey is the key the failed logins of an account are counted
+// under. Unknown logins are counted too, so they are throttled the same way
+// and don't stand out.
+func loginAccountKey(login string, user *models.Users) string {
+	if user != nil {
+		return "user:" + strconv.Itoa(user.ID)
+	}
+	return "login:" + strings.ToLower(login)
+}
+
+func loginIPKey(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// loginAttempt is a login counted against the account and the IP address
+// before the password or code is checked, so a burst of concurrent guesses
+// can't get past the throttling
+type loginAttempt struct {
+	accountKey string
+	ipKey      string
+	// accountUntil and ipUntil are until when the next attempts have to
+	// wait if this one fails
+	accountUntil time.Time
+	ipUntil      time.Time
+	lockedOut    bool
+}
+
+// authenticate checks the password of the user logging in with login. The
+// password isn't even hashed while the account or the IP address has to
+// wait after too many failures, which fails with ErrLoginThrottled. The
+// attempt of an authenticated user stays counted until the caller ends it
+// with loginSucceeded, loginFailed or refundLoginAttempt, once it knows
+// whether a second factor is needed and right.
+func (a *Application) authenticate(r *http.Request, login, password string) (*models.Users, *loginAttempt, error) {
+	user, err := a.models.Users.FindByLogin(login)
+	if err != nil && !errors.Is(err, models.ErrNoMoreRows) {
+		return nil, nil, err
+	}
+	at, err := a.startLoginAttempt(r, user, login)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	authenticated, err := a.models.Users.AuthenticateUser(user, password)
+	switch {
+	case errors.Is(err, models.ErrInvalidLogin):
+		a.loginFailed(r, user, login, at)
+		return nil, nil, err
+	case isLoginError(err):
+		// the password was right, the account just may not log in
+		if err := a.refundLoginAttempt(at); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, err
+	case err != nil:
+		return nil, nil, err
+	}
+	return authenticated, at, nil
+}
+
+// isLoginError reports whether err is a refused login rather than a failure
+// of the server
+func isLoginError(err error) bool {
+	return errors.Is(err, models.ErrInvalidLogin) ||
+		errors.Is(err, models.ErrUserNotActive) ||
+		errors.Is(err, models.ErrUserBanned) ||
+		errors.Is(err, models.ErrLoginThrottled)
+}
+
+// startLoginAttempt counts an attempt to log in as user, or with login when
+// it matches no account. While the IP address or the account has to wait it
+// fails with ErrLoginThrottled, telling how long, and nothing is counted.
+func (a *Application) startLoginAttempt(r *http.Request, user *models.Users, login string) (*loginAttempt, error) {
+	at := &loginAttempt{accountKey: loginAccountKey(login, user), ipKey: loginIPKey(r)}
+	var err error
+	at.ipUntil, _, err = a.models.LoginThrottles.Attempt(at.ipKey, a.ipLoginPolicy())
+	if err != nil {
+		return nil, loginThrottled(at.ipUntil, err)
+	}
+	at.accountUntil, at.lockedOut, err = a.models.LoginThrottles.Attempt(at.accountKey, a.accountLoginPolicy())
+	if err != nil {
+		if err := a.models.LoginThrottles.Refund(at.ipKey, at.ipUntil); err != nil {
+			a.errLog.Println(err)
+		}
+		return nil, loginThrottled(at.accountUntil, err)
+	}
+	return at, nil
+}
+
+// loginThrottled adds how long to wait to ErrLoginThrottled
+func loginThrottled(until time.Time, err error) error {
+	if !errors.Is(err, models.ErrLoginThrottled) {
+		return err
+	}
+	loginMetrics.Add(metricLoginThrottled, 1)
+	return fmt.Errorf("%w, please try again in %s", err, humanWait(time.Until(until)))
+}
+
+// loginSucceeded takes the attempt back. The failures of the account are
+// forgotten, while the IP address only gets this attempt back since others
+// may be guessing from it.
+func (a *Application) loginSucceeded(at *loginAttempt) error {
+	if err := a.models.LoginThrottles.Clear(at.accountKey); err != nil {
+		return err
+	}
+	return a.models.LoginThrottles.Refund(at.ipKey, at.ipUntil)
+}
+
+// refundLoginAttempt takes the attempt back without forgetting the earlier
+// failures of the account, when the password was right but the user still
+// has to enter their two-factor code on another page
+func (a *Application) refundLoginAttempt(at *loginAttempt) error {
+	if err := a.models.LoginThrottles.Refund(at.accountKey, at.accountUntil); err != nil {
+		return err
+	}
+	return a.models.LoginThrottles.Refund(at.ipKey, at.ipUntil)
+}
+
+// loginFailed is called once the password or two-factor code of the
+// attempt turned out wrong. The owner of an account that got locked out is
+// told by email, at most once per login.failure_window.
+func (a *Application) loginFailed(r *http.Request, user *models.Users, login string, at *loginAttempt) {
+	loginMetrics.Add(metricLoginFailed, 1)
+	if !at.ipUntil.IsZero() {
+		loginMetrics.Add(metricIPBackoffs, 1)
+	}
+	if !at.lockedOut {
+		return
+	}
+	loginMetrics.Add(metricLockouts, 1)
+
+	e := models.AuditEvent{Action: models.AuditAccountLockout}
+	if user != nil {
+		e = auditOn(models.AuditAccountLockout, "user", user.ID)
+	}
+	e.Metadata = models.AuditMetadata{"login": login, "until": at.accountUntil}
+	a.audit(r, e)
+	if user == nil {
+		return
+	}
+	notify, err := a.models.LoginThrottles.Notify(at.accountKey, a.config.Login.FailureWindow.Std())
+	if err != nil {
+		a.errLog.Println(err)
+		return
+	}
+	if !notify {
+		return
+	}
+
+	err = a.sendEmail(user.Email, "account_locked", map[string]interface{}{
+		"Username": user.Username,
+		"Until":    at.accountUntil,
+		"IP":       clientIP(r),
+		"Link":     a.config.PublicURL() + "/password/forgot",
+	})
+	if err != nil {
+		a.errLog.Println(err)
+	}
+}
+
+// humanWait rounds d up to whole seconds or minutes
+func humanWait(d time.Duration) string {
+	if d < time.Minute {
+		s := int(math.Ceil(d.Seconds()))
+		if s <= 1 {
+			return "a second"
+		}
+		return fmt.Sprintf("%d seconds", s)
+	}
+	m := int(math.Ceil(d.Minutes()))
+	if m == 1 {
+		return "a minute"
+	}
+	return fmt.Sprintf("%d minutes", m)
+}
@@ -1,9 +1,17 @@
 package base
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"strings"
+	"webapp/models"
 
 	"github.com/justinas/nosurf"
 )
@@ -18,23 +26,217 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// realIP replaces the peer address of the requests forwarded by a trusted
+// proxy with the address of the client, so clientIP sees the client
+func (a *Application) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := a.forwardedFor(r); ip != "" {
+			r.RemoteAddr = net.JoinHostPort(ip, "0")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedFor walks X-Forwarded-For from the right, where the trusted
+// proxies appended the addresses they got the request from, and returns the
+// first one that isn't a trusted proxy. Everything left of it may have been
+// made up by the client.
+func (a *Application) forwardedFor(r *http.Request) string {
+	if !a.isTrustedProxy(clientIP(r)) {
+		return ""
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			return ""
+		}
+		if !a.isTrustedProxy(hop) {
+			return hop
+		}
+	}
+	return ""
+}
+
+func (a *Application) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range a.trustedProxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *Application) loadSession(next http.Handler) http.Handler {
 	return a.session.LoadAndSave(next)
 }
 
+// authenticateSession loads the user of a logged in session into the
+// request context. Sessions whose account is gone, deactivated or whose
+// session version was bumped (e.g. by a password reset) are signed out, as
+// are banned users and revoked or untracked sessions.
+func (a *Application) authenticateSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := a.session.GetInt(r.Context(), sessionKeyUserID)
+		if userID == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := a.models.Users.GetByID(userID)
+		if err != nil && !errors.Is(err, models.ErrNoMoreRows) {
+			a.serverErr(w, err)
+			return
+		}
+		if err != nil || !user.Activated || user.IsBanned() || user.SessionVersion != a.session.GetInt(r.Context(), sessionKeySessionVersion) {
+			a.logOut(r)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// sessions started before sessions were tracked have no row, so they
+		// couldn't be revoked and have to log in again
+		sessionID := a.session.GetInt(r.Context(), sessionKeySessionID)
+		err = models.ErrNoMoreRows
+		if sessionID != 0 {
+			err = a.models.Sessions.Seen(sessionID, user.ID, clientIP(r))
+		}
+		if errors.Is(err, models.ErrNoMoreRows) {
+			a.logOut(r)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			a.serverErr(w, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), contextKeyUser, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func (a *Application) authRequired(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID := a.session.GetInt(r.Context(), sessionKeyUserID)
+		userID := a.currentUserID(r)
 		if userID == 0 {
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
-		w.Header().Add("Cache-Controle", "no-store")
+		w.Header().Add("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	}
+}
+
+// requireRole lets through only users with role or a more privileged one,
+// see models.Users.HasRole. It must be wrapped by authRequired.
+func (a *Application) requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r)
+		if user == nil || !user.HasRole(role) {
+			a.clientErr(w, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// apiAuthRequired is the JSON API flavour of authRequired: it answers with a
+// 401 error envelope instead of redirecting to the login page
+func (a *Application) apiAuthRequired(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := a.currentUserID(r)
+		if userID == 0 {
+			a.errorJSON(w, http.StatusUnauthorized, "You must be logged in to access this resource")
+			return
+		}
+		w.Header().Add("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	}
+}
+
+// authenticateToken authenticates API requests carrying an
+// "Authorization: Bearer <token>" header. Requests without the header fall
+// back to the cookie session.
+func (a *Application) authenticateToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scheme, plain, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			a.errorJSON(w, http.StatusUnauthorized, "Authorization header must use the Bearer scheme")
+			return
+		}
+
+		token, err := a.models.APITokens.Authenticate(strings.TrimSpace(plain))
+		if err != nil {
+			if errors.Is(err, models.ErrInvalidToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				a.errorJSON(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			a.modelErrorJSON(w, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), contextKeyAPIToken, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// apiJSONRequired rejects the API writes authenticated by the session cookie
+// that aren't sent as JSON, even those without a body. Browsers only send
+// that content type cross-site after a CORS preflight, which is what keeps
+// the API safe from CSRF without nosurf tokens. Requests with an API token
+// carry no cookie the browser could add on its own.
+func (a *Application) apiJSONRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if apiTokenFromContext(r) == nil && mediaType != "application/json" {
+			a.badRequestJSON(w, errUnsupportedMediaType)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireScope rejects requests authenticated with an API token that was
+// not granted scope. Session users may do everything.
+func (a *Application) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := apiTokenFromContext(r)
+		if token != nil && !token.HasScope(scope) {
+			a.errorJSON(w, http.StatusForbidden, fmt.Sprintf("This API token is missing the %q scope", scope))
+			return
+		}
 		next.ServeHTTP(w, r)
 	}
 }
 
 func (a *Application) csrfTokenRequired(next http.Handler) http.Handler {
 	csrfHandler := nosurf.New(next)
+	// the JSON API is protected by requiring a JSON content type instead, see
+	// apiJSONRequired
+	csrfHandler.ExemptFunc(func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, apiPrefix+"/")
+	})
 	return csrfHandler
 }
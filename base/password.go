@@ -0,0 +1,139 @@
+package base
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"webapp/forms"
+	"webapp/models"
+
+	"github.com/CloudyKit/jet/v6"
+)
+
+func (a *Application) forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	err := a.render(w, r, "forgot_password", nil)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) forgotPasswordPostHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*2)
+
+	err := r.ParseForm()
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Email("email")
+	if !form.Valid() {
+		vars := make(jet.VarMap)
+		vars.Set("errors", form.Errors)
+		err := a.render(w, r, "forgot_password", vars)
+		if err != nil {
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+		}
+		return
+	}
+
+	user, err := a.models.Users.GetByEmail(form.Get("email"))
+	switch {
+	case err == nil:
+		if err := a.sendPasswordResetEmail(user); err != nil {
+			a.errLog.Println(err)
+		}
+	case !errors.Is(err, models.ErrNoMoreRows):
+		a.errLog.Println(err)
+	}
+
+	// same answer for known and unknown emails, see resendActivationPostHandler
+	a.session.Put(r.Context(), "success", "If an account exists for that email, a password reset link is on its way.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func (a *Application) sendPasswordResetEmail(user *models.Users) error {
+	token, expiry, err := a.models.PasswordResets.New(user.ID, a.config.Security.PasswordResetTTL.Std())
+	if err != nil {
+		return err
+	}
+	return a.sendEmail(user.Email, "password_reset", map[string]interface{}{
+		"Username": user.Username,
+		"Link":     a.config.PublicURL() + "/password/reset?token=" + url.QueryEscape(token),
+		"Expiry":   expiry,
+	})
+}
+
+func (a *Application) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	vars := make(jet.VarMap)
+	vars.Set("token", r.URL.Query().Get("token"))
+	err := a.render(w, r, "reset_password", vars)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) resetPasswordPostHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*2)
+
+	err := r.ParseForm()
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	validateNewPasswordForm(form)
+	form.Required("token")
+	if !form.Valid() {
+		vars := make(jet.VarMap)
+		vars.Set("token", form.Get("token"))
+		vars.Set("errors", form.Errors)
+		err := a.render(w, r, "reset_password", vars)
+		if err != nil {
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+		}
+		return
+	}
+
+	user, err := a.models.PasswordResets.Reset(form.Get("token"), form.Get("password"))
+	if err != nil {
+		if !errors.Is(err, models.ErrInvalidResetToken) {
+			a.errLog.Println(err)
+			err = errors.New("Error while resetting your password")
+		}
+		a.session.Put(r.Context(), "flash", err.Error())
+		http.Redirect(w, r, "/password/forgot", http.StatusSeeOther)
+		return
+	}
+	a.audit(r, auditBy(user, models.AuditPasswordReset, "user", user.ID))
+	if _, err := a.models.Sessions.RevokeOthers(user.ID, 0); err != nil {
+		a.errLog.Println(err)
+	}
+	// the new password may be used right away, even if the account was
+	// locked out by someone guessing the old one
+	if err := a.models.LoginThrottles.Clear(loginAccountKey("", user)); err != nil {
+		a.errLog.Println(err)
+	}
+
+	// every session of the user, including this one if it was logged in, is
+	// now outdated
+	a.logOut(r)
+	a.session.Put(r.Context(), "success", "Your password has been changed and all your sessions were signed out. You can login now.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// validateNewPasswordForm checks a new password and its confirmation. The
+// length rules must stay within the ones of validateLoginForm.
+func validateNewPasswordForm(form *forms.Form) {
+	form.Required("password", "confirm_password")
+	form.MinLength("password", 8).MaxLength("password", 16)
+	form.Equal("password", "confirm_password")
+}
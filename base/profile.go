@@ -0,0 +1,136 @@
+package base
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"webapp/forms"
+	"webapp/models"
+
+	"github.com/CloudyKit/jet/v6"
+	"github.com/gorilla/mux"
+)
+
+// aboutMaxLength is the longest about text of a profile
+const aboutMaxLength = 500
+
+// profileHandler shows the public profile of a user with either their
+// submissions or, with tab=comments, their comments
+func (a *Application) profileHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.profileUser(w, r)
+	if !ok {
+		return
+	}
+	karma, err := a.models.Users.Karma(user.ID)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	tab := r.URL.Query().Get("tab")
+	if tab != "comments" {
+		tab = "submissions"
+	}
+	filter := models.Filters{
+		Page:     a.readIntDefault(r, "page", 1),
+		PageSize: a.readIntDefault(r, "page_size", 10),
+		OrderBy:  "latest",
+		Author:   user.Username,
+	}
+	if err := filter.Validate(); err != nil {
+		a.clientErr(w, http.StatusBadRequest)
+		return
+	}
+
+	vars := make(jet.VarMap)
+	var meta models.MetaData
+	if tab == "comments" {
+		var comments []models.UserComment
+		comments, meta, err = a.models.Comments.GetByUser(user.ID, filter)
+		vars.Set("comments", comments)
+	} else {
+		var posts []models.Posts
+		posts, meta, err = a.models.Posts.GetPosts(filter)
+		if err == nil {
+			err = a.setUserVotes(r, postPointers(posts)...)
+		}
+		vars.Set("posts", posts)
+	}
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	query := url.Values{}
+	query.Set("tab", tab)
+	query.Set("page_size", strconv.Itoa(filter.PageSize))
+	query.Set("page", strconv.Itoa(meta.NextPage))
+	nextURL := query.Encode()
+	query.Set("page", strconv.Itoa(meta.PrevPage))
+	prevURL := query.Encode()
+
+	vars.Set("user", user)
+	vars.Set("karma", karma)
+	vars.Set("tab", tab)
+	vars.Set("meta", meta)
+	vars.Set("nextUrl", nextURL)
+	vars.Set("prevUrl", prevURL)
+	vars.Set("aboutMaxLength", aboutMaxLength)
+	if err := a.render(w, r, "profile", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+// profileAboutHandler changes the about text, users can only change their
+// own profile
+func (a *Application) profileAboutHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*4)
+	user, ok := a.profileUser(w, r)
+	if !ok {
+		return
+	}
+	if user.ID != a.currentUserID(r) {
+		a.clientErr(w, http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	form := forms.New(r.PostForm)
+	form.MaxLength("about", aboutMaxLength)
+	if !form.Valid() {
+		a.session.Put(r.Context(), "flash", form.Errors.First("about"))
+		http.Redirect(w, r, user.ProfileURL(), http.StatusSeeOther)
+		return
+	}
+
+	if err := a.models.Users.SetAbout(user.ID, form.Get("about")); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	a.session.Put(r.Context(), "success", "Profile updated")
+	http.Redirect(w, r, user.ProfileURL(), http.StatusSeeOther)
+}
+
+// profileUser reads the user whose profile is in the URL
+func (a *Application) profileUser(w http.ResponseWriter, r *http.Request) (*models.Users, bool) {
+	user, err := a.models.Users.GetByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		if errors.Is(err, models.ErrNoMoreRows) {
+			a.clientErr(w, http.StatusNotFound)
+			return nil, false
+		}
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return nil, false
+	}
+	return user, true
+}
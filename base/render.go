@@ -3,6 +3,8 @@ package base
 import (
 	"fmt"
 	"net/http"
+	"time"
+	"webapp/models"
 
 	"github.com/CloudyKit/jet/v6"
 	"github.com/justinas/nosurf"
@@ -13,10 +15,18 @@ type TemplateData struct {
 	URL             string
 	IsAuthenticated bool
 	AuthUser        string
+	AuthUserID      int
 	Flash           string
 	Success         string
 	Error           string
 	CSRFToken       string
+	// EditWindow is how long authors can edit their posts and comments
+	EditWindow time.Duration
+	// AuthRole is the role of the logged in user, IsModerator and IsAdmin
+	// are also set for the roles above them
+	AuthRole    string
+	IsModerator bool
+	IsAdmin     bool
 }
 
 func (a *Application) defaultData(td *TemplateData, r *http.Request) *TemplateData {
@@ -27,11 +37,20 @@ func (a *Application) defaultData(td *TemplateData, r *http.Request) *TemplateDa
 			// this means user is logged in
 			td.IsAuthenticated = true
 			td.AuthUser = a.session.GetString(r.Context(), sessionKeyUsername)
+			td.AuthUserID = a.session.GetInt(r.Context(), sessionKeyUserID)
 		}
 		td.Flash = a.session.PopString(r.Context(), "flash")
 		td.Success = a.session.PopString(r.Context(), "success")
 	}
+	if user := userFromContext(r); user != nil {
+		td.AuthRole = user.Role
+		td.IsModerator = user.HasRole(models.RoleModerator)
+		td.IsAdmin = user.HasRole(models.RoleAdmin)
+	}
 	td.CSRFToken = nosurf.Token(r)
+	if a.config != nil {
+		td.EditWindow = a.config.Content.EditWindow.Std()
+	}
 	return td
 }
 
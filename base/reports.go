@@ -0,0 +1,155 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"webapp/forms"
+	"webapp/models"
+
+	"github.com/gorilla/mux"
+)
+
+// resolvedShown is how many recent resolutions the moderation queue lists
+const resolvedShown = 20
+
+func (a *Application) reportPostHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+	back := fmt.Sprintf("/comments/%d", postID)
+
+	form, ok := a.readReportForm(w, r, back)
+	if !ok {
+		return
+	}
+	hidden, err := a.models.Reports.ReportPost(postID, a.currentUserID(r), form.Get("reason"), form.Get("details"),
+		a.config.Reports.HideThreshold, a.config.Reports.EstablishedAge.Std())
+	if err == nil {
+		a.audit(r, auditReport("post", postID, form, hidden))
+	}
+	a.reportDone(w, r, err, hidden, back)
+}
+
+func (a *Application) reportCommentHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+	commentID, _ := strconv.Atoi(mux.Vars(r)["commentID"])
+	back := fmt.Sprintf("/comments/%d#comment-%d", postID, commentID)
+
+	form, ok := a.readReportForm(w, r, back)
+	if !ok {
+		return
+	}
+	if !a.commentOnPost(w, r, commentID, postID) {
+		return
+	}
+	hidden, err := a.models.Reports.ReportComment(commentID, a.currentUserID(r), form.Get("reason"), form.Get("details"),
+		a.config.Reports.HideThreshold, a.config.Reports.EstablishedAge.Std())
+	if err == nil {
+		a.audit(r, auditReport("comment", commentID, form, hidden))
+	}
+	a.reportDone(w, r, err, hidden, back)
+}
+
+// auditReport returns the event of a report, hidden tells whether the
+// report hid the content
+func auditReport(targetType string, targetID int, form *forms.Form, hidden bool) models.AuditEvent {
+	e := auditOn(models.AuditReportCreate, targetType, targetID)
+	e.Metadata = models.AuditMetadata{"reason": form.Get("reason"), "hidden": hidden}
+	return e
+}
+
+// readReportForm parses a report form, invalid forms are flashed on the
+// page at back
+func (a *Application) readReportForm(w http.ResponseWriter, r *http.Request, back string) (*forms.Form, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*2)
+	if err := r.ParseForm(); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return nil, false
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("reason").MaxLength("details", 500)
+	if !form.Valid() {
+		msg := form.Errors.First("reason")
+		if msg == "" {
+			msg = form.Errors.First("details")
+		}
+		a.session.Put(r.Context(), "flash", msg)
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return nil, false
+	}
+	return form, true
+}
+
+func (a *Application) reportDone(w http.ResponseWriter, r *http.Request, err error, hidden bool, back string) {
+	switch {
+	case err == nil && hidden:
+		a.session.Put(r.Context(), "success", "Thanks for the report, this is hidden until a moderator reviews it")
+	case err == nil:
+		a.session.Put(r.Context(), "success", "Thanks for the report, a moderator will have a look")
+	case errors.Is(err, models.ErrNoMoreRows):
+		a.clientErr(w, http.StatusNotFound)
+		return
+	case errors.Is(err, models.ErrDuplicateReport),
+		errors.Is(err, models.ErrInvalidReason),
+		errors.Is(err, models.ErrOwnContent):
+		a.session.Put(r.Context(), "flash", err.Error())
+	default:
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+func (a *Application) adminReportsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, ok := a.adminFilters(w, r)
+	if !ok {
+		return
+	}
+	items, meta, err := a.models.Reports.Queue(filter)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	resolved, err := a.models.Reports.RecentlyResolved(resolvedShown)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	vars := a.adminVars(filter, meta)
+	vars.Set("items", items)
+	vars.Set("resolved", resolved)
+	if err := a.render(w, r, "admin_reports", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) resolvePostReportsHandler(w http.ResponseWriter, r *http.Request) {
+	postID, _ := strconv.Atoi(mux.Vars(r)["postID"])
+	resolution := r.PostFormValue("resolution")
+	err := a.models.Reports.ResolvePost(postID, a.currentUserID(r), resolution)
+	if err == nil {
+		e := auditOn(models.AuditReportResolve, "post", postID)
+		e.Metadata = models.AuditMetadata{"resolution": resolution}
+		a.audit(r, e)
+	}
+	a.adminActionDone(w, r, err, "Reports "+resolution)
+}
+
+func (a *Application) resolveCommentReportsHandler(w http.ResponseWriter, r *http.Request) {
+	commentID, _ := strconv.Atoi(mux.Vars(r)["commentID"])
+	resolution := r.PostFormValue("resolution")
+	err := a.models.Reports.ResolveComment(commentID, a.currentUserID(r), resolution)
+	if err == nil {
+		e := auditOn(models.AuditReportResolve, "comment", commentID)
+		e.Metadata = models.AuditMetadata{"resolution": resolution}
+		a.audit(r, e)
+	}
+	a.adminActionDone(w, r, err, "Reports "+resolution)
+}
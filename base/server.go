@@ -5,9 +5,14 @@ import (
 	"database/sql"
 	"fmt"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
+	"webapp/config"
+	"webapp/mailer"
 	"webapp/models"
 
 	"log"
@@ -22,35 +27,52 @@ type Application struct {
 	appName string
 	server  Server
 	debug   bool
+	config  *config.Config
 	infoLog log.Logger
 	errLog  log.Logger
 	view    *jet.Set
 	session *scs.SessionManager
 	models  models.Models
+	mailer  mailer.Mailer
+	wg      sync.WaitGroup // wg tracks the background goroutines, e.g. sending emails
+	// trustedProxies are the ranges of server.trusted_proxies
+	trustedProxies []netip.Prefix
 }
 
 // Server ...
 type Server struct {
-	host string
-	port string
+	host         string
+	port         string
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
 }
 
 // GetApplicationInstance ...
-func GetApplicationInstance(appName, host, port string, db *sql.DB, upperDB db.Session) *Application {
-	jetSet := initJet()
-	sess := initSession(appName, host, db)
+func GetApplicationInstance(cfg *config.Config, db *sql.DB, upperDB db.Session) *Application {
+	jetSet := initJet(cfg.Views)
+	sess := initSession(cfg, db)
+	// the config was validated already
+	trustedProxies, _ := cfg.Server.TrustedProxyPrefixes()
 	return &Application{
-		appName: appName,
+		appName: cfg.App.Name,
 		server: Server{
-			host: host,
-			port: port,
+			host:         cfg.Server.Host,
+			port:         cfg.Server.Port,
+			readTimeout:  cfg.Server.ReadTimeout.Std(),
+			writeTimeout: cfg.Server.WriteTimeout.Std(),
+			idleTimeout:  cfg.Server.IdleTimeout.Std(),
 		},
-		debug:   true,
+		debug:   cfg.App.Debug,
+		config:  cfg,
 		infoLog: *log.New(os.Stdout, "INFO\t", log.Ltime|log.Ldate|log.Lshortfile),
 		errLog:  *log.New(os.Stderr, "ERROR\t", log.Ltime|log.Ldate|log.Llongfile),
 		view:    jetSet,
 		session: sess,
-		models:  models.NewModel(upperDB),
+		models:  models.NewModel(upperDB, []byte(cfg.Security.Secret)),
+		mailer:  initMailer(cfg.Mailer),
+
+		trustedProxies: trustedProxies,
 	}
 }
 
@@ -58,8 +80,11 @@ func GetApplicationInstance(appName, host, port string, db *sql.DB, upperDB db.S
 func (a *Application) GetServer(h http.Handler) *http.Server {
 	url := fmt.Sprintf("%s:%s", a.server.host, a.server.port)
 	srv := http.Server{
-		Handler: h,
-		Addr:    url,
+		Handler:      h,
+		Addr:         url,
+		ReadTimeout:  a.server.readTimeout,
+		WriteTimeout: a.server.writeTimeout,
+		IdleTimeout:  a.server.idleTimeout,
 	}
 	a.infoLog.Printf("Starting HTTP server on %s", url)
 	return &srv
@@ -81,5 +106,7 @@ func (a *Application) GracefulShutdown(srv *http.Server, e error) {
 	if errHTTPServer := srv.Shutdown(context.Background()); errHTTPServer != nil {
 		a.errLog.Println("failed to gracefully shutdown HTTP server", errHTTPServer.Error())
 	}
+	a.infoLog.Println("waiting for background tasks to finish")
+	a.wg.Wait()
 	a.infoLog.Println("server shutdown complete, application will now exit")
 }
@@ -0,0 +1,77 @@
+package base
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"webapp/models"
+
+	"github.com/CloudyKit/jet/v6"
+	"github.com/gorilla/mux"
+)
+
+// sessionsHandler lists the devices the user is logged in on
+func (a *Application) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessions, err := a.models.Sessions.ListForUser(a.currentUserID(r), a.session.Lifetime)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("sessions", sessions)
+	vars.Set("currentSessionID", a.session.GetInt(r.Context(), sessionKeySessionID))
+	if err := a.render(w, r, "sessions", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+// revokeSessionHandler signs out one of the sessions of the user, revoking
+// the current session is the same as logging out
+func (a *Application) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, _ := strconv.Atoi(mux.Vars(r)["sessionID"])
+	if sessionID == a.session.GetInt(r.Context(), sessionKeySessionID) {
+		a.logoutHandler(w, r)
+		return
+	}
+
+	err := a.models.Sessions.Revoke(sessionID, a.currentUserID(r))
+	if err != nil {
+		if errors.Is(err, models.ErrNoMoreRows) {
+			a.clientErr(w, http.StatusNotFound)
+			return
+		}
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	a.audit(r, auditOn(models.AuditSessionRevoke, "session", sessionID))
+
+	a.session.Put(r.Context(), "success", "The session was signed out")
+	http.Redirect(w, r, "/settings/sessions", http.StatusSeeOther)
+}
+
+// revokeOtherSessionsHandler signs out every session of the user but the
+// current one
+func (a *Application) revokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := a.currentUserID(r)
+	n, err := a.models.Sessions.RevokeOthers(userID, a.session.GetInt(r.Context(), sessionKeySessionID))
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	e := auditOn(models.AuditSessionsRevoke, "user", userID)
+	e.Metadata = models.AuditMetadata{"count": n}
+	a.audit(r, e)
+
+	if err := a.session.RenewToken(r.Context()); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	a.session.Put(r.Context(), "success", "You were signed out everywhere else")
+	http.Redirect(w, r, "/settings/sessions", http.StatusSeeOther)
+}
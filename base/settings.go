@@ -0,0 +1,293 @@
+package base
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"webapp/forms"
+	"webapp/models"
+
+	"github.com/CloudyKit/jet/v6"
+)
+
+// settingsHandler shows the forms changing the password, email and username
+// of the logged in user
+func (a *Application) settingsHandler(w http.ResponseWriter, r *http.Request) {
+	a.renderSettings(w, r, make(jet.VarMap))
+}
+
+func (a *Application) renderSettings(w http.ResponseWriter, r *http.Request, vars jet.VarMap) {
+	user, err := a.models.Users.GetByID(a.currentUserID(r))
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	vars.Set("user", user)
+	vars.Set("nextUsernameChange", user.NextUsernameChange(a.config.Account.UsernameCooldown.Std()))
+	if user.HasTwoFactor() {
+		left, err := a.models.TwoFactor.RecoveryCodesLeft(user.ID)
+		if err != nil {
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+			return
+		}
+		vars.Set("recoveryCodesLeft", left)
+	}
+	if err := a.render(w, r, "settings", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+// settingsForm parses the posted settings form, it is nil when the request
+// already got an error
+func (a *Application) settingsForm(w http.ResponseWriter, r *http.Request) *forms.Form {
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*2)
+	if err := r.ParseForm(); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return nil
+	}
+	return forms.New(r.PostForm)
+}
+
+// checkPassword checks the password the user confirms a change with in
+// field. Wrong passwords count as failed logins of the account, so a stolen
+// session can't be used to guess it. The field fails when the password is
+// wrong or the account has to wait, the error is a server error.
+func (a *Application) checkPassword(r *http.Request, form *forms.Form, field string) error {
+	user := userFromContext(r)
+	at, err := a.startLoginAttempt(r, user, user.Username)
+	if errors.Is(err, models.ErrLoginThrottled) {
+		form.Fail(field, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = a.models.Users.CheckPassword(user.ID, form.Get(field))
+	if errors.Is(err, models.ErrWrongPassword) {
+		a.loginFailed(r, user, user.Username, at)
+		form.Fail(field, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return a.loginSucceeded(at)
+}
+
+// settingsFailed renders the settings page again with the errors of form
+func (a *Application) settingsFailed(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	vars := make(jet.VarMap)
+	vars.Set("errors", form.Errors)
+	a.renderSettings(w, r, vars)
+}
+
+// changePasswordHandler sets a new password after checking the current one.
+// The other sessions of the user are signed out and this one is renewed.
+func (a *Application) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	form := a.settingsForm(w, r)
+	if form == nil {
+		return
+	}
+	form.Required("current_password")
+	validateNewPasswordForm(form)
+	if form.Valid() {
+		if err := a.checkPassword(r, form, "current_password"); err != nil {
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+			return
+		}
+	}
+	if !form.Valid() {
+		a.settingsFailed(w, r, form)
+		return
+	}
+
+	user, err := a.models.Users.SetPassword(a.currentUserID(r), form.Get("password"))
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	a.audit(r, auditOn(models.AuditPasswordChange, "user", user.ID))
+
+	if _, err := a.models.Sessions.RevokeOthers(user.ID, a.session.GetInt(r.Context(), sessionKeySessionID)); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	if err := a.refreshSession(r, user); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	a.session.Put(r.Context(), "success", "Your password has been changed, your other sessions were signed out")
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// changeEmailHandler emails a confirmation link to the new address after
+// checking the password of the user, the email of the account only changes
+// once the link is opened
+func (a *Application) changeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	form := a.settingsForm(w, r)
+	if form == nil {
+		return
+	}
+	form.Email("email")
+	form.Required("email_password")
+	user := userFromContext(r)
+	if form.Valid() && strings.EqualFold(form.Get("email"), user.Email) {
+		form.Fail("email", "This is already your email")
+	}
+	if form.Valid() {
+		if err := a.checkPassword(r, form, "email_password"); err != nil {
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+			return
+		}
+	}
+	if !form.Valid() {
+		a.settingsFailed(w, r, form)
+		return
+	}
+
+	newEmail := form.Get("email")
+	token, expiry, err := a.models.EmailChanges.New(user.ID, newEmail, a.config.Security.EmailChangeTTL.Std())
+	if err != nil {
+		if errors.Is(err, models.ErrDuplicateEmail) {
+			form.Fail("email", err.Error())
+			a.settingsFailed(w, r, form)
+			return
+		}
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	err = a.sendEmail(newEmail, "email_change", map[string]interface{}{
+		"Username": user.Username,
+		"Link":     a.config.PublicURL() + "/settings/email/confirm?token=" + url.QueryEscape(token),
+		"Expiry":   expiry,
+	})
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	e := auditOn(models.AuditEmailChangeAsk, "user", user.ID)
+	e.Metadata = models.AuditMetadata{"new_email": newEmail}
+	a.audit(r, e)
+
+	if err := a.session.RenewToken(r.Context()); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	a.session.Put(r.Context(), "success", "Open the link we sent to "+newEmail+" to confirm your new email")
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// confirmEmailHandler only shows a confirmation form, for the same reason
+// as activateHandler
+func (a *Application) confirmEmailHandler(w http.ResponseWriter, r *http.Request) {
+	vars := make(jet.VarMap)
+	vars.Set("token", r.URL.Query().Get("token"))
+	if err := a.render(w, r, "confirm_email", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) confirmEmailPostHandler(w http.ResponseWriter, r *http.Request) {
+	form := a.settingsForm(w, r)
+	if form == nil {
+		return
+	}
+
+	user, oldEmail, err := a.models.EmailChanges.Confirm(form.Get("token"))
+	if err != nil {
+		if !errors.Is(err, models.ErrInvalidEmailChangeToken) && !errors.Is(err, models.ErrDuplicateEmail) {
+			a.errLog.Println(err)
+			err = errors.New("Error while changing your email")
+		}
+		a.session.Put(r.Context(), "flash", err.Error())
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	e := auditBy(user, models.AuditEmailChange, "user", user.ID)
+	e.Metadata = models.AuditMetadata{"old_email": oldEmail, "new_email": user.Email}
+	a.audit(r, e)
+
+	// the previous address learns about the change, in case it wasn't theirs
+	err = a.sendEmail(oldEmail, "email_changed", map[string]interface{}{
+		"Username": user.Username,
+		"NewEmail": user.Email,
+	})
+	if err != nil {
+		a.errLog.Println(err)
+	}
+
+	back := "/login"
+	if a.currentUserID(r) == user.ID {
+		if err := a.refreshSession(r, user); err != nil {
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+			return
+		}
+		back = "/settings"
+	}
+	a.session.Put(r.Context(), "success", "Your email is now "+user.Email)
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// changeUsernameHandler renames the user, at most once per
+// account.username_cooldown
+func (a *Application) changeUsernameHandler(w http.ResponseWriter, r *http.Request) {
+	form := a.settingsForm(w, r)
+	if form == nil {
+		return
+	}
+	form.Required("username").Username("username")
+	user := userFromContext(r)
+	if form.Valid() && form.Get("username") == user.Username {
+		form.Fail("username", "This is already your username")
+	}
+	if !form.Valid() {
+		a.settingsFailed(w, r, form)
+		return
+	}
+
+	oldUsername := user.Username
+	err := a.models.Users.ChangeUsername(user.ID, form.Get("username"), a.config.Account.UsernameCooldown.Std())
+	if err != nil {
+		if errors.Is(err, models.ErrDuplicateUsername) || errors.Is(err, models.ErrUsernameCooldown) {
+			form.Fail("username", err.Error())
+			a.settingsFailed(w, r, form)
+			return
+		}
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	e := auditOn(models.AuditUsernameChange, "user", user.ID)
+	e.ActorName = form.Get("username")
+	e.Metadata = models.AuditMetadata{"old_username": oldUsername, "new_username": form.Get("username")}
+	a.audit(r, e)
+
+	user, err = a.models.Users.GetByID(user.ID)
+	if err == nil {
+		err = a.refreshSession(r, user)
+	}
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	a.session.Put(r.Context(), "success", "Your username is now "+user.Username)
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
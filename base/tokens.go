@@ -0,0 +1,91 @@
+package base
+
+import (
+	"net/http"
+	"strconv"
+	"webapp/forms"
+	"webapp/models"
+
+	"github.com/CloudyKit/jet/v6"
+	"github.com/gorilla/mux"
+)
+
+// tokensHandler lists the API tokens of the logged in user
+func (a *Application) tokensHandler(w http.ResponseWriter, r *http.Request) {
+	a.renderTokens(w, r, make(jet.VarMap))
+}
+
+func (a *Application) renderTokens(w http.ResponseWriter, r *http.Request, vars jet.VarMap) {
+	tokens, err := a.models.APITokens.GetForUser(a.currentUserID(r))
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	vars.Set("tokens", tokens)
+	vars.Set("scopes", models.AllScopes)
+	err = a.render(w, r, "tokens", vars)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) tokensPostHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*2)
+
+	err := r.ParseForm()
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name", "scopes").MaxLength("name", 100)
+	vars := make(jet.VarMap)
+	if !form.Valid() {
+		vars.Set("errors", form.Errors)
+		a.renderTokens(w, r, vars)
+		return
+	}
+
+	plain, token, err := a.models.APITokens.Insert(a.currentUserID(r), form.Get("name"), r.PostForm["scopes"])
+	if err != nil {
+		a.errLog.Println(err)
+		form.Fail("scopes", err.Error())
+		vars.Set("errors", form.Errors)
+		a.renderTokens(w, r, vars)
+		return
+	}
+
+	e := auditOn(models.AuditTokenCreate, "api_token", token.ID)
+	e.Metadata = models.AuditMetadata{"name": token.Name, "scopes": token.Scopes}
+	a.audit(r, e)
+
+	// the plain token is rendered once and never stored, not even in the session
+	vars.Set("newToken", plain)
+	vars.Set("newTokenName", token.Name)
+	a.renderTokens(w, r, vars)
+}
+
+func (a *Application) revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.Atoi(mux.Vars(r)["tokenID"])
+	if err != nil {
+		a.clientErr(w, http.StatusBadRequest)
+		return
+	}
+
+	err = a.models.APITokens.Revoke(tokenID, a.currentUserID(r))
+	if err != nil {
+		a.errLog.Println(err)
+		a.session.Put(r.Context(), "flash", "Error while revoking the token")
+		http.Redirect(w, r, "/settings/tokens", http.StatusSeeOther)
+		return
+	}
+
+	a.audit(r, auditOn(models.AuditTokenRevoke, "api_token", tokenID))
+	a.session.Put(r.Context(), "success", "Token revoked")
+	http.Redirect(w, r, "/settings/tokens", http.StatusSeeOther)
+}
@@ -0,0 +1,337 @@
+package base
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"webapp/forms"
+	"webapp/models"
+	"webapp/totp"
+
+	"github.com/CloudyKit/jet/v6"
+	"rsc.io/qr"
+)
+
+// twoFactorLoginTTL is how long a user who entered their password has to
+// enter their code
+const twoFactorLoginTTL = 5 * time.Minute
+
+// startTwoFactorLogin keeps the user whose password was verified in the
+// session, without logging them in until they also entered a code
+func (a *Application) startTwoFactorLogin(r *http.Request, user *models.Users) error {
+	if err := a.session.RenewToken(r.Context()); err != nil {
+		return err
+	}
+	a.session.Put(r.Context(), sessionKeyTwoFactorUserID, user.ID)
+	a.session.Put(r.Context(), sessionKeyTwoFactorStarted, time.Now().Unix())
+	return nil
+}
+
+func (a *Application) clearTwoFactorLogin(r *http.Request) {
+	a.session.Remove(r.Context(), sessionKeyTwoFactorUserID)
+	a.session.Remove(r.Context(), sessionKeyTwoFactorStarted)
+}
+
+// twoFactorLoginUser returns the user halfway through logging in, it is nil
+// when there is none or they took too long
+func (a *Application) twoFactorLoginUser(r *http.Request) (*models.Users, error) {
+	userID := a.session.GetInt(r.Context(), sessionKeyTwoFactorUserID)
+	if userID == 0 {
+		return nil, nil
+	}
+	started := time.Unix(a.session.GetInt64(r.Context(), sessionKeyTwoFactorStarted), 0)
+	if time.Since(started) > twoFactorLoginTTL {
+		a.clearTwoFactorLogin(r)
+		return nil, nil
+	}
+
+	// the account may have changed since the password was checked
+	user, err := a.models.Users.GetByID(userID)
+	if err != nil && !errors.Is(err, models.ErrNoMoreRows) {
+		return nil, err
+	}
+	if err != nil || !user.Activated || user.IsBanned() || !user.HasTwoFactor() {
+		a.clearTwoFactorLogin(r)
+		return nil, nil
+	}
+	return user, nil
+}
+
+// twoFactorLoginHandler asks the user who entered their password for their
+// code
+func (a *Application) twoFactorLoginHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := a.twoFactorLoginUser(r)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err := a.render(w, r, "login_2fa", make(jet.VarMap)); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+func (a *Application) twoFactorLoginPostHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1024*2)
+	if err := r.ParseForm(); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	user, err := a.twoFactorLoginUser(r)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	if user == nil {
+		a.session.Put(r.Context(), "flash", "Your login expired, please log in again")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	if !form.Valid() {
+		a.twoFactorLoginFailed(w, r, form)
+		return
+	}
+
+	// wrong codes count as failed logins of the account too
+	at, err := a.startLoginAttempt(r, user, user.Username)
+	if err != nil {
+		if !errors.Is(err, models.ErrLoginThrottled) {
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+			return
+		}
+		a.clearTwoFactorLogin(r)
+		a.session.Put(r.Context(), "flash", "Login error: "+err.Error())
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	usedRecoveryCode, err := a.models.TwoFactor.Verify(user.ID, form.Get("code"))
+	switch {
+	case errors.Is(err, models.ErrInvalidTwoFactorCode):
+		a.audit(r, auditOn(models.AuditTwoFactorFailed, "user", user.ID))
+		a.loginFailed(r, user, user.Username, at)
+		form.Fail("code", err.Error())
+		a.twoFactorLoginFailed(w, r, form)
+		return
+	case errors.Is(err, models.ErrTooManyTwoFactorCodes):
+		a.clearTwoFactorLogin(r)
+		a.session.Put(r.Context(), "flash", err.Error())
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	case err != nil:
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	if err := a.loginSucceeded(at); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	a.clearTwoFactorLogin(r)
+	if err := a.logIn(r, user); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	e := auditBy(user, models.AuditLogin, "user", user.ID)
+	e.Metadata = models.AuditMetadata{"two_factor": "totp"}
+	if usedRecoveryCode {
+		e.Metadata["two_factor"] = "recovery_code"
+	}
+	a.audit(r, e)
+
+	if usedRecoveryCode {
+		left, err := a.models.TwoFactor.RecoveryCodesLeft(user.ID)
+		if err != nil {
+			a.errLog.Println(err)
+		}
+		a.session.Put(r.Context(), "flash", fmt.Sprintf("You logged in with a recovery code, %d are left. Generate new ones if you lost your authenticator app.", left))
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// twoFactorLoginFailed shows the code form again. The number of wrong codes
+// is limited by TwoFactorModel.Verify.
+func (a *Application) twoFactorLoginFailed(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	vars := make(jet.VarMap)
+	vars.Set("errors", form.Errors)
+	if err := a.render(w, r, "login_2fa", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+// twoFactorSetupHandler shows the QR code and the secret to add to an
+// authenticator app, which the user confirms with a code of the app
+func (a *Application) twoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	a.renderTwoFactorSetup(w, r, make(jet.VarMap))
+}
+
+func (a *Application) renderTwoFactorSetup(w http.ResponseWriter, r *http.Request, vars jet.VarMap) {
+	user := userFromContext(r)
+	secret, err := a.models.TwoFactor.Setup(user.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrTwoFactorEnabled) {
+			http.Redirect(w, r, "/settings", http.StatusSeeOther)
+			return
+		}
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+
+	uri := totp.URI(a.appName, user.Username, secret)
+	code, err := qr.Encode(uri, qr.M)
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	vars.Set("qrCode", "data:image/png;base64,"+base64.StdEncoding.EncodeToString(code.PNG()))
+	vars.Set("secret", groupSecret(secret))
+	if err := a.render(w, r, "two_factor_setup", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+// twoFactorEnableHandler turns two-factor authentication on once the user
+// entered a code of their app, and shows their recovery codes
+func (a *Application) twoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	form := a.settingsForm(w, r)
+	if form == nil {
+		return
+	}
+	form.Required("code")
+	var codes []string
+	if form.Valid() {
+		var err error
+		codes, err = a.models.TwoFactor.Enable(a.currentUserID(r), form.Get("code"))
+		switch {
+		case errors.Is(err, models.ErrTwoFactorEnabled):
+			http.Redirect(w, r, "/settings", http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrInvalidTwoFactorCode):
+			form.Fail("code", err.Error())
+		case err != nil:
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+			return
+		}
+	}
+	if !form.Valid() {
+		vars := make(jet.VarMap)
+		vars.Set("errors", form.Errors)
+		a.renderTwoFactorSetup(w, r, vars)
+		return
+	}
+	a.audit(r, auditOn(models.AuditTwoFactorEnable, "user", a.currentUserID(r)))
+
+	a.session.Put(r.Context(), "success", "Two-factor authentication is on")
+	a.renderRecoveryCodes(w, r, codes)
+}
+
+// twoFactorDisableHandler turns two-factor authentication off after
+// checking the password of the user
+func (a *Application) twoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	form := a.twoFactorPasswordForm(w, r)
+	if form == nil {
+		return
+	}
+	err := a.models.TwoFactor.Disable(a.currentUserID(r))
+	if err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	a.audit(r, auditOn(models.AuditTwoFactorDisable, "user", a.currentUserID(r)))
+
+	a.session.Put(r.Context(), "success", "Two-factor authentication is off")
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// recoveryCodesHandler replaces the recovery codes of the user after
+// checking their password
+func (a *Application) recoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	form := a.twoFactorPasswordForm(w, r)
+	if form == nil {
+		return
+	}
+	codes, err := a.models.TwoFactor.RegenerateRecoveryCodes(a.currentUserID(r))
+	if err != nil {
+		if errors.Is(err, models.ErrTwoFactorDisabled) {
+			http.Redirect(w, r, "/settings", http.StatusSeeOther)
+			return
+		}
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+		return
+	}
+	a.audit(r, auditOn(models.AuditRecoveryCodes, "user", a.currentUserID(r)))
+
+	a.session.Put(r.Context(), "success", "Your old recovery codes no longer work")
+	a.renderRecoveryCodes(w, r, codes)
+}
+
+// twoFactorPasswordForm parses the settings form confirming a two-factor
+// change with the password, it is nil when the request already got a
+// response
+func (a *Application) twoFactorPasswordForm(w http.ResponseWriter, r *http.Request) *forms.Form {
+	form := a.settingsForm(w, r)
+	if form == nil {
+		return nil
+	}
+	form.Required("twofactor_password")
+	if form.Valid() {
+		if err := a.checkPassword(r, form, "twofactor_password"); err != nil {
+			a.errLog.Println(err)
+			a.serverErr(w, err)
+			return nil
+		}
+	}
+	if !form.Valid() {
+		a.settingsFailed(w, r, form)
+		return nil
+	}
+	return form
+}
+
+// renderRecoveryCodes shows the recovery codes, this is the only time the
+// user gets to see them
+func (a *Application) renderRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string) {
+	vars := make(jet.VarMap)
+	vars.Set("codes", codes)
+	if err := a.render(w, r, "recovery_codes", vars); err != nil {
+		a.errLog.Println(err)
+		a.serverErr(w, err)
+	}
+}
+
+// groupSecret splits the secret in groups of four characters, which is
+// easier to type into an app
+func groupSecret(secret string) string {
+	var groups []string
+	for len(secret) > 4 {
+		groups = append(groups, secret[:4])
+		secret = secret[4:]
+	}
+	return strings.Join(append(groups, secret), " ")
+}
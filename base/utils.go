@@ -7,34 +7,67 @@ import (
 	"net/http"
 	"runtime/debug"
 	"strconv"
+	"strings"
+	"webapp/config"
+	"webapp/mailer"
+	"webapp/models"
 
 	"github.com/CloudyKit/jet/v6"
 	"github.com/alexedwards/scs/postgresstore"
 	"github.com/alexedwards/scs/v2"
 )
 
-func initJet() *jet.Set {
-	return jet.NewSet(
-		jet.NewOSFileSystemLoader("./views"),
-		jet.InDevelopmentMode(),
-	)
+func initJet(cfg config.ViewsConfig) *jet.Set {
+	opts := []jet.Option{}
+	if cfg.DevMode {
+		opts = append(opts, jet.InDevelopmentMode())
+	}
+	return jet.NewSet(jet.NewOSFileSystemLoader(cfg.Dir), opts...)
 }
 
-func initSession(appName, host string, db *sql.DB) *scs.SessionManager {
+func initSession(cfg *config.Config, db *sql.DB) *scs.SessionManager {
 	sess := scs.New()
-	sess.Cookie.Domain = host
-	sess.Cookie.Name = appName
-	sess.Cookie.SameSite = http.SameSiteStrictMode
+	sess.Cookie.Domain = cfg.Session.CookieDomain
+	if sess.Cookie.Domain == "" {
+		sess.Cookie.Domain = cfg.Server.Host
+	}
+	sess.Cookie.Name = cfg.Session.CookieName
+	if sess.Cookie.Name == "" {
+		sess.Cookie.Name = cfg.App.Name
+	}
+	sess.Cookie.Secure = cfg.Session.Secure
+	switch strings.ToLower(cfg.Session.SameSite) {
+	case "lax":
+		sess.Cookie.SameSite = http.SameSiteLaxMode
+	case "none":
+		sess.Cookie.SameSite = http.SameSiteNoneMode
+	default:
+		sess.Cookie.SameSite = http.SameSiteStrictMode
+	}
+	sess.Lifetime = cfg.Session.Lifetime.Std()
+	sess.IdleTimeout = cfg.Session.IdleTimeout.Std()
 	sess.Store = postgresstore.New(db)
 	return sess
 }
 
+func initMailer(cfg config.MailerConfig) mailer.Mailer {
+	m, err := mailer.New(cfg)
+	if err != nil {
+		log.Fatalln("Cannot create the mailer", err)
+	}
+	return m
+}
+
 // OpenDB ...
-func OpenDB(dsn string) *sql.DB {
-	db, err := sql.Open("postgres", dsn)
+func OpenDB(cfg config.DBConfig) *sql.DB {
+	db, err := sql.Open("postgres", cfg.DSN)
 	if err != nil {
 		log.Fatalln("Cannot connect to DB", err)
 	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime.Std())
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime.Std())
 	err = db.Ping()
 	if err != nil {
 		log.Fatalln("Cannot connect to DB", err)
@@ -42,6 +75,29 @@ func OpenDB(dsn string) *sql.DB {
 	return db
 }
 
+// currentUserID returns the ID of the user authenticated by an API token or,
+// failing that, by the session. It is 0 for anonymous requests.
+func (a *Application) currentUserID(r *http.Request) int {
+	if token := apiTokenFromContext(r); token != nil {
+		return token.UserID
+	}
+	if user := userFromContext(r); user != nil {
+		return user.ID
+	}
+	return 0
+}
+
+// userFromContext returns the user of the session, see authenticateSession
+func userFromContext(r *http.Request) *models.Users {
+	user, _ := r.Context().Value(contextKeyUser).(*models.Users)
+	return user
+}
+
+func apiTokenFromContext(r *http.Request) *models.APITokens {
+	token, _ := r.Context().Value(contextKeyAPIToken).(*models.APITokens)
+	return token
+}
+
 func (a *Application) readIntFromURLQuery(r *http.Request, key string) int {
 	val, err := strconv.Atoi(r.URL.Query().Get(key))
 	if err != nil {
@@ -58,6 +114,37 @@ func (a *Application) readIntDefault(r *http.Request, key string, defVal int) in
 	return val
 }
 
+// background runs fn in a goroutine that is waited for on shutdown and
+// whose panics are logged instead of crashing the server
+func (a *Application) background(fn func()) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer func() {
+			if err := recover(); err != nil {
+				a.errLog.Printf("panic in background task: %v\n%s", err, debug.Stack())
+			}
+		}()
+		fn()
+	}()
+}
+
+// sendEmail renders the named email template and delivers it in the
+// background, so handlers never wait on the mail server
+func (a *Application) sendEmail(to, template string, data map[string]interface{}) error {
+	data["AppName"] = a.appName
+	msg, err := mailer.Compose(a.config.Mailer.From, to, template, data)
+	if err != nil {
+		return err
+	}
+	a.background(func() {
+		if err := a.mailer.Send(msg); err != nil {
+			a.errLog.Printf("sending %s email to %s: %v", template, to, err)
+		}
+	})
+	return nil
+}
+
 func (a *Application) serverErr(w http.ResponseWriter, err error) {
 	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
 	a.errLog.Output(2, trace)
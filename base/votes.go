@@ -0,0 +1,83 @@
+package base
+
+import (
+	"net/http"
+	"webapp/models"
+)
+
+// checkDownvote returns ErrNotEnoughKarma unless the user has enough karma
+// to cast the vote, upvotes and retractions are always allowed
+func (a *Application) checkDownvote(userID, value int) error {
+	if value >= 0 {
+		return nil
+	}
+	karma, err := a.models.Users.Karma(userID)
+	if err != nil {
+		return err
+	}
+	if karma < a.config.Votes.DownvoteKarma {
+		return models.ErrNotEnoughKarma
+	}
+	return nil
+}
+
+// setVote records a vote on a post after checking the user may cast it
+func (a *Application) setVote(postID, userID, value int) error {
+	if err := a.checkDownvote(userID, value); err != nil {
+		return err
+	}
+	return a.models.Posts.SetVote(postID, userID, value)
+}
+
+// setCommentVote records a vote on a comment after checking the user may cast it
+func (a *Application) setCommentVote(commentID, userID, value int) error {
+	if err := a.checkDownvote(userID, value); err != nil {
+		return err
+	}
+	return a.models.Comments.SetVote(commentID, userID, value)
+}
+
+// setUserVotes fills in the votes of the current user on the posts
+func (a *Application) setUserVotes(r *http.Request, posts ...*models.Posts) error {
+	userID := a.currentUserID(r)
+	if userID == 0 {
+		return nil
+	}
+	ids := make([]int, len(posts))
+	for i, post := range posts {
+		ids[i] = post.ID
+	}
+	votes, err := a.models.Posts.GetUserVotes(userID, ids)
+	if err != nil {
+		return err
+	}
+	for _, post := range posts {
+		post.UserVote = votes[post.ID]
+	}
+	return nil
+}
+
+// setCommentVotes fills in the votes of the current user on the comments of a post
+func (a *Application) setCommentVotes(r *http.Request, postID int, comments []models.Comments) error {
+	userID := a.currentUserID(r)
+	if userID == 0 || len(comments) == 0 {
+		return nil
+	}
+	votes, err := a.models.Comments.GetUserVotes(userID, postID)
+	if err != nil {
+		return err
+	}
+	for i := range comments {
+		comments[i].UserVote = votes[comments[i].ID]
+	}
+	return nil
+}
+
+// postPointers lets setUserVotes update a page of posts in place
+func postPointers(posts []models.Posts) []*models.Posts {
+	ptrs := make([]*models.Posts, len(posts))
+	for i := range posts {
+		ptrs[i] = &posts[i]
+	}
+	return ptrs
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"webapp/models"
+)
+
+const adminUsage = `usage: webapp [flags] admin promote USERNAME [user|moderator|admin]
+       webapp [flags] admin reset-2fa USERNAME`
+
+// runAdminCommand handles the "admin" subcommand. "admin promote alice"
+// makes alice an admin, which is how the first admin of a new install is
+// created; a role can be given to promote or demote to another role.
+// "admin reset-2fa alice" turns off two-factor authentication for alice,
+// for admins who can't log in to the dashboard themselves.
+func runAdminCommand(m models.Models, args []string) error {
+	if len(args) < 2 {
+		return errors.New(adminUsage)
+	}
+	switch {
+	case args[0] == "promote" && len(args) <= 3:
+		return promoteUser(m, args[1:])
+	case args[0] == "reset-2fa" && len(args) == 2:
+		return resetTwoFactor(m, args[1])
+	default:
+		return errors.New(adminUsage)
+	}
+}
+
+func promoteUser(m models.Models, args []string) error {
+	role := models.RoleAdmin
+	if len(args) == 2 {
+		role = args[1]
+	}
+	user, err := cliUser(m, args[0])
+	if err != nil {
+		return err
+	}
+	if err := m.Users.SetRole(user.ID, role); err != nil {
+		return err
+	}
+	// there is no request, the actor and IP stay empty
+	err = m.Audit.Record(&models.AuditEvent{
+		Action:     models.AuditRolePromoteByCLI,
+		TargetType: "user",
+		TargetID:   &user.ID,
+		Metadata:   models.AuditMetadata{"role": role, "username": user.Username},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is now %s\n", user.Username, role)
+	return nil
+}
+
+func resetTwoFactor(m models.Models, username string) error {
+	user, err := cliUser(m, username)
+	if err != nil {
+		return err
+	}
+	if !user.HasTwoFactor() {
+		return fmt.Errorf("%s doesn't use two-factor authentication", user.Username)
+	}
+	if err := m.TwoFactor.Disable(user.ID); err != nil {
+		return err
+	}
+	err = m.Audit.Record(&models.AuditEvent{
+		Action:     models.AuditTwoFactorReset,
+		TargetType: "user",
+		TargetID:   &user.ID,
+		Metadata:   models.AuditMetadata{"username": user.Username, "cli": true},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("two-factor authentication is off for %s\n", user.Username)
+	return nil
+}
+
+func cliUser(m models.Models, username string) (*models.Users, error) {
+	user, err := m.Users.GetByUsername(username)
+	if err != nil {
+		if errors.Is(err, models.ErrNoMoreRows) {
+			return nil, fmt.Errorf("no user named %q", username)
+		}
+		return nil, err
+	}
+	return user, nil
+}
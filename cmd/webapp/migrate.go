@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"webapp/migrations"
+)
+
+const migrateUsage = "usage: webapp [flags] migrate up|down|status|to N"
+
+// runMigrateCommand handles the "migrate" subcommand
+func runMigrateCommand(db *sql.DB, args []string) error {
+	m, err := migrations.New(db)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	ctx := context.Background()
+	var done []migrations.Step
+	switch args[0] {
+	case "up":
+		done, err = m.Up(ctx)
+	case "down":
+		done, err = m.Down(ctx)
+	case "to":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil || version < 0 {
+			return fmt.Errorf("invalid migration version %q", args[1])
+		}
+		done, err = m.To(ctx, version)
+	case "status":
+		return printMigrationStatus(ctx, m)
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	for _, step := range done {
+		verb := "migrated"
+		if step.RolledBack {
+			verb = "rolled back"
+		}
+		fmt.Printf("%s %06d_%s\n", verb, step.Version, step.Name)
+	}
+	if err == nil && len(done) == 0 {
+		fmt.Println("DB schema is already up to date")
+	}
+	return err
+}
+
+func printMigrationStatus(ctx context.Context, m *migrations.Migrator) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range statuses {
+		appliedAt := "pending"
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+		}
+		fmt.Fprintf(w, "%06d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+	return w.Flush()
+}
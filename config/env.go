@@ -0,0 +1,65 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// loadEnv overrides every field tagged with `env` whose variable (prefixed
+// with EnvPrefix) is set
+func (c *Config) loadEnv(lookup func(string) (string, bool)) error {
+	return walkEnv(reflect.ValueOf(c).Elem(), lookup)
+}
+
+func walkEnv(v reflect.Value, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		sf := t.Field(i)
+		if sf.Type.Kind() == reflect.Struct && sf.Tag.Get("env") == "" {
+			if err := walkEnv(field, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		name := sf.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		raw, ok := lookup(EnvPrefix + name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, raw); err != nil {
+			return fmt.Errorf("invalid value for %s%s: %w", EnvPrefix, name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, raw string) error {
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(raw))
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported config field type %s", field.Type())
+	}
+	return nil
+}
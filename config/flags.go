@@ -0,0 +1,42 @@
+package config
+
+import (
+	"flag"
+)
+
+// Flags are the command line overrides, the last layer of the configuration
+type Flags struct {
+	fs    *flag.FlagSet
+	host  *string
+	port  *string
+	dsn   *string
+	debug *bool
+}
+
+// RegisterFlags defines the config override flags on fs
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	return &Flags{
+		fs:    fs,
+		host:  fs.String("host", "", "Host the HTTP server listens on (overrides server.host)"),
+		port:  fs.String("port", "", "Port the HTTP server listens on (overrides server.port)"),
+		dsn:   fs.String("dsn", "", "Postgres connection string (overrides db.dsn)"),
+		debug: fs.Bool("debug", false, "Enable debug logging and jet development mode (overrides app.debug)"),
+	}
+}
+
+// Apply copies the flags that were explicitly set on the command line into cfg
+func (f *Flags) Apply(cfg *Config) {
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "host":
+			cfg.Server.Host = *f.host
+		case "port":
+			cfg.Server.Port = *f.port
+		case "dsn":
+			cfg.DB.DSN = *f.dsn
+		case "debug":
+			cfg.App.Debug = *f.debug
+			cfg.Views.DevMode = *f.debug
+		}
+	})
+}
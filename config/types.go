@@ -0,0 +1,79 @@
+package config
+
+import (
+	"io"
+	"net/url"
+	"reflect"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "[redacted]"
+
+// Duration is a time.Duration that is written and read as "10s", "15m" etc.
+// in config files and environment variables
+type Duration time.Duration
+
+// Std returns the value as a time.Duration
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+// MarshalText ...
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText ...
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Redacted returns a copy of the config with every field tagged `secret`
+// masked, so it is safe to print or log
+func (c *Config) Redacted() *Config {
+	cp := *c
+	redact(reflect.ValueOf(&cp).Elem())
+	return &cp
+}
+
+func redact(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		switch {
+		case field.Kind() == reflect.Struct && t.Field(i).Tag.Get("secret") == "":
+			redact(field)
+		case field.Kind() != reflect.String || field.String() == "":
+		case t.Field(i).Tag.Get("secret") == "dsn":
+			field.SetString(redactDSN(field.String()))
+		case t.Field(i).Tag.Get("secret") != "":
+			field.SetString(redacted)
+		}
+	}
+}
+
+// redactDSN only masks the password so the rest of the DSN stays readable
+func redactDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil {
+		return redacted
+	}
+	return u.Redacted()
+}
+
+// Print writes the config as YAML to w with the secrets redacted
+func (c *Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -13,6 +13,26 @@ type errs map[string][]string
 
 var emailRegex = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
+// usernameRegex allows letters, digits, underscores and hyphens, so
+// usernames are safe in URLs and can't be confused with an email address
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Lengths of a username
+const (
+	UsernameMinLength = 3
+	UsernameMaxLength = 20
+)
+
+// reservedUsernames can't be chosen, they could pass for staff or clash with
+// the pages of the site
+var reservedUsernames = map[string]bool{
+	"admin": true, "administrator": true, "moderator": true, "mod": true, "staff": true,
+	"root": true, "system": true, "support": true, "help": true, "security": true,
+	"api": true, "login": true, "logout": true, "signup": true, "settings": true,
+	"user": true, "users": true, "me": true, "anonymous": true, "deleted": true,
+	"null": true, "undefined": true,
+}
+
 // Form ...
 type Form struct {
 	url.Values
@@ -48,6 +68,21 @@ func (f *Form) Email(field string) *Form {
 	return f
 }
 
+// Username checks the length and characters of a username and that it isn't
+// reserved
+func (f *Form) Username(field string) *Form {
+	val := f.Get(field)
+	switch n := utf8.RuneCountInString(val); {
+	case n < UsernameMinLength || n > UsernameMaxLength:
+		f.Errors.Add(field, fmt.Sprintf("The username must be %d to %d characters long", UsernameMinLength, UsernameMaxLength))
+	case !usernameRegex.MatchString(val):
+		f.Errors.Add(field, "The username may only contain letters, digits, underscores and hyphens")
+	case reservedUsernames[strings.ToLower(val)]:
+		f.Errors.Add(field, "This username is reserved")
+	}
+	return f
+}
+
 // MinLength checks the required min length criteria for a field in form
 func (f *Form) MinLength(field string, d int) *Form {
 	val := f.Get(field)
@@ -100,6 +135,14 @@ func (f *Form) URL(field string) *Form {
 	return f
 }
 
+// Equal checks that two fields hold the same value, e.g. a password and its confirmation
+func (f *Form) Equal(field, other string) *Form {
+	if f.Get(field) != f.Get(other) {
+		f.Errors.Add(other, fmt.Sprintf("%s does not match %s", other, field))
+	}
+	return f
+}
+
 // GetInt returns the int value for a field
 func (f *Form) GetInt(field string) int {
 	val, err := strconv.Atoi(f.Get(field))
@@ -3,14 +3,18 @@ module webapp
 go 1.21.3
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/CloudyKit/jet/v6 v6.2.0
 	github.com/alexedwards/scs/postgresstore v0.0.0-20231113091146-cef4b05350c8
 	github.com/alexedwards/scs/v2 v2.7.0
 	github.com/golang-module/carbon/v2 v2.2.14
 	github.com/gorilla/mux v1.8.1
+	github.com/justinas/nosurf v1.1.1
 	github.com/lib/pq v1.10.9
 	github.com/upper/db/v4 v4.7.0
 	golang.org/x/crypto v0.12.0
+	gopkg.in/yaml.v3 v3.0.1
+	rsc.io/qr v0.2.0
 )
 
 require (
@@ -23,7 +27,6 @@ require (
 	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
 	github.com/jackc/pgtype v1.14.0 // indirect
 	github.com/jackc/pgx/v4 v4.18.1 // indirect
-	github.com/justinas/nosurf v1.1.1 // indirect
 	github.com/segmentio/fasthash v1.0.3 // indirect
 	golang.org/x/text v0.13.0 // indirect
 )
@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Log prints every email to stdout instead of sending it
+type Log struct {
+	logger *log.Logger
+}
+
+// NewLog ...
+func NewLog() *Log {
+	return &Log{logger: log.New(os.Stdout, "MAIL\t", log.Ltime|log.Ldate)}
+}
+
+// Send ...
+func (l *Log) Send(msg Message) error {
+	l.logger.Printf("to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// File writes every email as an .eml file into a directory, which is handy
+// for tests and for opening the emails in a mail client during development
+type File struct {
+	dir string
+	seq atomic.Int64
+}
+
+// NewFile creates dir if needed
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &File{dir: dir}, nil
+}
+
+// Send ...
+func (f *File) Send(msg Message) error {
+	to := strings.NewReplacer("@", "_at_", "<", "", ">", "", " ", "_", "/", "_").Replace(msg.To)
+	name := fmt.Sprintf("%s-%03d-%s.eml", msg.Date.Format("20060102T150405"), f.seq.Add(1)%1000, to)
+	return os.WriteFile(filepath.Join(f.dir, name), msg.bytes(), 0o640)
+}
@@ -0,0 +1,86 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"webapp/config"
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+// Message is a plain text email
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+	Date    time.Time
+}
+
+// Mailer delivers emails. SMTP sends them for real, File and Log keep them
+// local for development and tests.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// New returns the mailer selected by cfg.Driver
+func New(cfg config.MailerConfig) (Mailer, error) {
+	switch cfg.Driver {
+	case "smtp":
+		return NewSMTP(cfg), nil
+	case "file":
+		return NewFile(cfg.Dir)
+	case "log":
+		return NewLog(), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer driver %q", cfg.Driver)
+	}
+}
+
+// Compose renders the templates/<name>.tmpl email template with data. The
+// template must define a "subject" and a "body" block.
+func Compose(from, to, name string, data interface{}) (Message, error) {
+	tmpl, err := template.ParseFS(templateFS, "templates/"+name+".tmpl")
+	if err != nil {
+		return Message{}, err
+	}
+
+	var subject, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Message{}, err
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return Message{}, err
+	}
+
+	return Message{
+		From:    from,
+		To:      to,
+		Subject: subject.String(),
+		Body:    body.String(),
+		Date:    time.Now(),
+	}, nil
+}
+
+// headerSanitizer keeps user controlled values from injecting extra headers
+var headerSanitizer = strings.NewReplacer("\r", "", "\n", "")
+
+// bytes returns the message in RFC 5322 format
+func (m Message) bytes() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", headerSanitizer.Replace(m.From))
+	fmt.Fprintf(&buf, "To: %s\r\n", headerSanitizer.Replace(m.To))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", headerSanitizer.Replace(m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", m.Date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
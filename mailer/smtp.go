@@ -0,0 +1,39 @@
+package mailer
+
+import (
+	"fmt"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+
+	"webapp/config"
+)
+
+// SMTP sends emails through an SMTP server, using STARTTLS when the server
+// offers it
+type SMTP struct {
+	addr string
+	auth smtp.Auth
+}
+
+// NewSMTP ...
+func NewSMTP(cfg config.MailerConfig) *SMTP {
+	s := &SMTP{addr: cfg.Host + ":" + strconv.Itoa(cfg.Port)}
+	if cfg.Username != "" {
+		s.auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	return s
+}
+
+// Send ...
+func (s *SMTP) Send(msg Message) error {
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender: %w", err)
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient: %w", err)
+	}
+	return smtp.SendMail(s.addr, s.auth, from.Address, []string{to.Address}, msg.bytes())
+}
@@ -1,5 +1,6 @@
-DROP TABLE IF EXISTS users CASCADE;
-CREATE TABLE users (
+-- The IF NOT EXISTS clauses let databases created by the old tables.sql script
+-- adopt the migration history without losing their data.
+CREATE TABLE IF NOT EXISTS users (
     id bigserial PRIMARY KEY,
     created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
     email TEXT UNIQUE NOT NULL,
@@ -8,8 +9,7 @@ CREATE TABLE users (
     activated bool NOT NULL DEFAULT false
 );
 
-DROP TABLE IF EXISTS posts CASCADE;
-CREATE TABLE posts (
+CREATE TABLE IF NOT EXISTS posts (
     id bigserial PRIMARY KEY,
     created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
     title text UNIQUE NOT NULL,
@@ -17,8 +17,7 @@ CREATE TABLE posts (
     user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE
 );
 
-DROP TABLE IF EXISTS comments CASCADE;
-CREATE TABLE comments (
+CREATE TABLE IF NOT EXISTS comments (
     id bigserial PRIMARY KEY,
     created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
     body text NOT NULL,
@@ -26,19 +25,17 @@ CREATE TABLE comments (
     user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE
 );
 
-DROP TABLE IF EXISTS votes CASCADE;
-CREATE TABLE votes (
+CREATE TABLE IF NOT EXISTS votes (
     created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
     user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
     post_id bigint NOT NULL REFERENCES posts ON DELETE CASCADE,
     PRIMARY KEY (user_id, post_id)
 );
 
-DROP TABLE IF EXISTS sessions;
-CREATE TABLE sessions (
+CREATE TABLE IF NOT EXISTS sessions (
 	token TEXT PRIMARY KEY,
 	data BYTEA NOT NULL,
 	expiry TIMESTAMPTZ NOT NULL
 );
 
-CREATE INDEX sessions_expiry_idx ON sessions (expiry);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS sessions_expiry_idx ON sessions (expiry);
\ No newline at end of file
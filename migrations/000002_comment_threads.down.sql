@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS comments_post_parent_idx;
+
+ALTER TABLE comments DROP COLUMN IF EXISTS parent_id;
@@ -0,0 +1,3 @@
+ALTER TABLE comments ADD COLUMN parent_id bigint REFERENCES comments ON DELETE CASCADE;
+
+CREATE INDEX comments_post_parent_idx ON comments (post_id, parent_id);
@@ -0,0 +1,11 @@
+CREATE TABLE api_tokens (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    name text NOT NULL,
+    token_hash bytea UNIQUE NOT NULL,
+    scopes text[] NOT NULL,
+    last_used_at timestamp(0) with time zone
+);
+
+CREATE INDEX api_tokens_user_idx ON api_tokens (user_id);
@@ -0,0 +1,7 @@
+CREATE TABLE activation_tokens (
+    token_hash bytea PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX activation_tokens_user_idx ON activation_tokens (user_id);
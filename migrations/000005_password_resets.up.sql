@@ -0,0 +1,10 @@
+CREATE TABLE password_reset_tokens (
+    token_hash bytea PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX password_reset_tokens_user_idx ON password_reset_tokens (user_id);
+
+-- bumped whenever every session of the user must be signed out
+ALTER TABLE users ADD COLUMN session_version integer NOT NULL DEFAULT 0;
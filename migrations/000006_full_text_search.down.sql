@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS comments_search_idx;
+ALTER TABLE comments DROP COLUMN IF EXISTS search_vector;
+
+DROP INDEX IF EXISTS posts_search_idx;
+ALTER TABLE posts DROP COLUMN IF EXISTS search_vector;
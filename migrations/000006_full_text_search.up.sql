@@ -0,0 +1,14 @@
+-- the url host is indexed with its dots replaced by spaces, so that searching
+-- "ycombinator" finds posts linking to news.ycombinator.com
+ALTER TABLE posts ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+    setweight(to_tsvector('english', replace(coalesce(substring(url FROM '^[a-zA-Z][a-zA-Z0-9+.-]*://(?:[^@/]*@)?([^/:?#]+)'), ''), '.', ' ')), 'B')
+) STORED;
+
+CREATE INDEX posts_search_idx ON posts USING GIN (search_vector);
+
+ALTER TABLE comments ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+    to_tsvector('english', body)
+) STORED;
+
+CREATE INDEX comments_search_idx ON comments USING GIN (search_vector);
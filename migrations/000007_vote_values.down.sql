@@ -0,0 +1,2 @@
+DELETE FROM votes WHERE value < 0;
+ALTER TABLE votes DROP COLUMN IF EXISTS value;
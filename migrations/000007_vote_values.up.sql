@@ -0,0 +1,2 @@
+-- 1 is an upvote and -1 a downvote, retracting a vote deletes its row
+ALTER TABLE votes ADD COLUMN value smallint NOT NULL DEFAULT 1 CHECK (value IN (-1, 1));
@@ -0,0 +1,9 @@
+CREATE TABLE comment_votes (
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    comment_id bigint NOT NULL REFERENCES comments ON DELETE CASCADE,
+    value smallint NOT NULL CHECK (value IN (-1, 1)),
+    PRIMARY KEY (user_id, comment_id)
+);
+
+CREATE INDEX comment_votes_comment_idx ON comment_votes (comment_id);
@@ -0,0 +1,5 @@
+ALTER TABLE comments DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE comments DROP COLUMN IF EXISTS edited_at;
+
+ALTER TABLE posts DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE posts DROP COLUMN IF EXISTS edited_at;
@@ -0,0 +1,6 @@
+ALTER TABLE posts ADD COLUMN edited_at timestamp(0) with time zone;
+ALTER TABLE posts ADD COLUMN deleted_at timestamp(0) with time zone;
+
+-- deleted comments keep their row so their replies stay in place
+ALTER TABLE comments ADD COLUMN edited_at timestamp(0) with time zone;
+ALTER TABLE comments ADD COLUMN deleted_at timestamp(0) with time zone;
@@ -0,0 +1,22 @@
+-- every version of an edited post or comment, the first row of each holds
+-- the original content
+CREATE TABLE post_revisions (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    post_id bigint NOT NULL REFERENCES posts ON DELETE CASCADE,
+    editor_id bigint REFERENCES users ON DELETE SET NULL,
+    title text NOT NULL,
+    url text NOT NULL
+);
+
+CREATE INDEX post_revisions_post_idx ON post_revisions (post_id, id);
+
+CREATE TABLE comment_revisions (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    comment_id bigint NOT NULL REFERENCES comments ON DELETE CASCADE,
+    editor_id bigint REFERENCES users ON DELETE SET NULL,
+    body text NOT NULL
+);
+
+CREATE INDEX comment_revisions_comment_idx ON comment_revisions (comment_id, id);
@@ -0,0 +1,2 @@
+-- roles are ordered user < moderator < admin, each role may do what the lower ones can
+ALTER TABLE users ADD COLUMN role text NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin'));
@@ -0,0 +1,4 @@
+ALTER TABLE posts DROP COLUMN IF EXISTS locked_at;
+
+ALTER TABLE users DROP COLUMN IF EXISTS ban_reason;
+ALTER TABLE users DROP COLUMN IF EXISTS banned_at;
@@ -0,0 +1,6 @@
+-- banned users can't log in and their sessions and API tokens stop working
+ALTER TABLE users ADD COLUMN banned_at timestamp(0) with time zone;
+ALTER TABLE users ADD COLUMN ban_reason text NOT NULL DEFAULT '';
+
+-- locked posts don't take new comments
+ALTER TABLE posts ADD COLUMN locked_at timestamp(0) with time zone;
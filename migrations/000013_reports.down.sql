@@ -0,0 +1,4 @@
+ALTER TABLE comments DROP COLUMN IF EXISTS hidden_at;
+ALTER TABLE posts DROP COLUMN IF EXISTS hidden_at;
+
+DROP TABLE IF EXISTS reports;
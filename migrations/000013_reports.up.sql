@@ -0,0 +1,27 @@
+-- a report flags either a post or a comment. Resolving an item resolves all
+-- of its open reports, the resolution is kept on every one of them.
+CREATE TABLE reports (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    reporter_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    post_id bigint REFERENCES posts ON DELETE CASCADE,
+    comment_id bigint REFERENCES comments ON DELETE CASCADE,
+    reason text NOT NULL CHECK (reason IN ('spam', 'abuse', 'off_topic', 'other')),
+    details text NOT NULL DEFAULT '',
+    -- established tells whether the reporter's account was old enough for the
+    -- report to count towards hiding the item
+    established bool NOT NULL DEFAULT false,
+    resolved_at timestamp(0) with time zone,
+    resolver_id bigint REFERENCES users ON DELETE SET NULL,
+    resolution text CHECK (resolution IN ('dismissed', 'removed', 'banned')),
+    CHECK ((post_id IS NULL) <> (comment_id IS NULL))
+);
+
+-- a user can report an item once
+CREATE UNIQUE INDEX reports_post_reporter_key ON reports (post_id, reporter_id) WHERE post_id IS NOT NULL;
+CREATE UNIQUE INDEX reports_comment_reporter_key ON reports (comment_id, reporter_id) WHERE comment_id IS NOT NULL;
+CREATE INDEX reports_open_idx ON reports (created_at) WHERE resolved_at IS NULL;
+
+-- hidden items wait for a moderator to review them
+ALTER TABLE posts ADD COLUMN hidden_at timestamp(0) with time zone;
+ALTER TABLE comments ADD COLUMN hidden_at timestamp(0) with time zone;
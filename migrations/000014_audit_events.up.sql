@@ -0,0 +1,31 @@
+-- audit_events is append-only. actor_id has no foreign key on purpose:
+-- deleting a user must not rewrite the events they caused, actor_name keeps
+-- who they were.
+CREATE TABLE audit_events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    actor_id bigint,
+    actor_name text NOT NULL DEFAULT '',
+    action text NOT NULL,
+    target_type text NOT NULL DEFAULT '',
+    target_id bigint,
+    ip text NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT '',
+    metadata jsonb NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);
+CREATE INDEX audit_events_action_idx ON audit_events (action, created_at);
+CREATE INDEX audit_events_actor_idx ON audit_events (actor_id, created_at);
+CREATE INDEX audit_events_target_idx ON audit_events (target_type, target_id);
+
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_no_change BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
@@ -0,0 +1,2 @@
+-- about is the free text shown on the public profile of a user
+ALTER TABLE users ADD COLUMN about text NOT NULL DEFAULT '';
@@ -0,0 +1,28 @@
+-- usernames were not unique, later accounts sharing a name (ignoring case)
+-- with an older one get their ID appended so the index can be built. The
+-- name is cut to stay within the 20 characters of a username, and a counter
+-- is added in the rare case the result is taken too (a real "bob_5").
+DO $$
+DECLARE
+	dup RECORD;
+	suffix TEXT;
+	candidate TEXT;
+	n INT;
+BEGIN
+	FOR dup IN
+		SELECT u.id, u.username FROM users u
+		WHERE EXISTS (SELECT 1 FROM users o WHERE lower(o.username) = lower(u.username) AND o.id < u.id)
+		ORDER BY u.id
+	LOOP
+		n := 0;
+		LOOP
+			suffix := '_' || dup.id || CASE WHEN n > 0 THEN '_' || n ELSE '' END;
+			candidate := left(dup.username, 20 - length(suffix)) || suffix;
+			EXIT WHEN NOT EXISTS (SELECT 1 FROM users WHERE lower(username) = lower(candidate));
+			n := n + 1;
+		END LOOP;
+		UPDATE users SET username = candidate WHERE id = dup.id;
+	END LOOP;
+END $$;
+
+CREATE UNIQUE INDEX users_username_key ON users (lower(username));
@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN IF EXISTS username_changed_at;
+DROP TABLE IF EXISTS email_change_tokens;
@@ -0,0 +1,13 @@
+-- a new email address only replaces the old one once the link sent to it
+-- is opened
+CREATE TABLE email_change_tokens (
+    token_hash bytea PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    new_email text NOT NULL,
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX email_change_tokens_user_idx ON email_change_tokens (user_id);
+
+-- username changes are rate limited
+ALTER TABLE users ADD COLUMN username_changed_at timestamp(0) with time zone;
@@ -0,0 +1,14 @@
+-- user_sessions describes the logged in sessions of the users. The session
+-- data itself stays in the sessions table of scs, which is keyed by a token
+-- that changes on every renewal, so each session carries the ID of its row
+-- here instead. Deleting a row signs its session out on its next request.
+CREATE TABLE user_sessions (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    last_seen_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    ip text NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX user_sessions_user_idx ON user_sessions (user_id, last_seen_at);
@@ -0,0 +1,16 @@
+-- the TOTP secret is stored while the user sets up their authenticator app
+-- and two-factor authentication is on once totp_enabled_at is set.
+-- totp_last_step is the period of the last accepted code, so a code can't
+-- be used twice.
+ALTER TABLE users ADD COLUMN totp_secret text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_enabled_at timestamp(0) with time zone;
+ALTER TABLE users ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0;
+
+-- one-time recovery codes for when the authenticator app is lost, stored
+-- signed like the emailed tokens
+CREATE TABLE recovery_codes (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    code_hash bytea NOT NULL,
+    used_at timestamp(0) with time zone,
+    PRIMARY KEY (user_id, code_hash)
+);
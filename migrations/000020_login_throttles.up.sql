@@ -0,0 +1,11 @@
+-- failed logins counted per key, which is user:<id> for an account,
+-- login:<login> for a login that matches no account and ip:<address> for a
+-- client. No login is accepted for a key until blocked_until.
+CREATE TABLE login_throttles (
+    key text PRIMARY KEY,
+    failures integer NOT NULL DEFAULT 0,
+    last_failure_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    blocked_until timestamp with time zone
+);
+
+CREATE INDEX login_throttles_last_failure_idx ON login_throttles (last_failure_at);
@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN IF EXISTS totp_attempted_at;
+ALTER TABLE users DROP COLUMN IF EXISTS totp_attempts;
@@ -0,0 +1,4 @@
+-- the codes entered for an account since its last accepted one, counted in
+-- the database so every login path shares the limit
+ALTER TABLE users ADD COLUMN totp_attempts integer NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN totp_attempted_at timestamp(0) with time zone;
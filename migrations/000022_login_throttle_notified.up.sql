@@ -0,0 +1,2 @@
+-- when the owner of a locked out account was last emailed about it
+ALTER TABLE login_throttles ADD COLUMN notified_at timestamp(0) with time zone;
@@ -0,0 +1,270 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// lockKey is the pg advisory lock held while migrating, so that two
+// instances started at the same time never apply migrations concurrently
+const lockKey = 7_233_941_002
+
+//go:embed *.sql
+var files embed.FS
+
+var fileRegex = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+var (
+	// ErrUnknownVersion ...
+	ErrUnknownVersion = errors.New("Unknown migration version")
+	// ErrNothingToRollback ...
+	ErrNothingToRollback = errors.New("No applied migration to roll back")
+)
+
+// Migration is a numbered pair of up and down scripts
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status tells whether a migration has been applied to the database
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Step is a migration Up, Down or To applied, or rolled back
+type Step struct {
+	Migration
+	RolledBack bool
+}
+
+// Migrator applies the embedded migrations to a postgres database
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// New returns a Migrator for the migrations embedded in this package
+func New(db *sql.DB) (*Migrator, error) {
+	migrations, err := load(files)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+func load(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, name := range names {
+		m := fileRegex.FindStringSubmatch(name)
+		if m == nil {
+			return nil, fmt.Errorf("migration file %s does not match NNNNNN_name.(up|down).sql", name)
+		}
+		version, _ := strconv.Atoi(m[1])
+		script, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two different names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(script)
+		} else {
+			mig.Down = string(script)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down script", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Latest returns the highest known migration version
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies every pending migration
+func (m *Migrator) Up(ctx context.Context) ([]Step, error) {
+	return m.To(ctx, m.Latest())
+}
+
+// Down rolls back the most recently applied migration
+func (m *Migrator) Down(ctx context.Context) ([]Step, error) {
+	var done []Step
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			if _, ok := applied[m.migrations[i].Version]; ok {
+				if err := m.apply(ctx, conn, m.migrations[i], false); err != nil {
+					return err
+				}
+				done = append(done, Step{Migration: m.migrations[i], RolledBack: true})
+				return nil
+			}
+		}
+		return ErrNothingToRollback
+	})
+	return done, err
+}
+
+// To migrates up or down until version is the latest applied migration.
+// Version 0 rolls back everything.
+func (m *Migrator) To(ctx context.Context, version int) ([]Step, error) {
+	if version != 0 && m.find(version) < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownVersion, version)
+	}
+
+	var done []Step
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; mig.Version <= version && !ok {
+				if err := m.apply(ctx, conn, mig, true); err != nil {
+					return err
+				}
+				done = append(done, Step{Migration: mig})
+			}
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; mig.Version > version && ok {
+				if err := m.apply(ctx, conn, mig, false); err != nil {
+					return err
+				}
+				done = append(done, Step{Migration: mig, RolledBack: true})
+			}
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status lists every known migration and whether it is applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			at, ok := applied[mig.Version]
+			statuses = append(statuses, Status{Migration: mig, Applied: ok, AppliedAt: at})
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+func (m *Migrator) find(version int) int {
+	for i, mig := range m.migrations {
+		if mig.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// withLock runs fn on a single connection holding the migration advisory
+// lock, after making sure the schema_migrations table exists
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		return fmt.Errorf("acquiring migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+	)`)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// apply runs one script and records it in schema_migrations in the same
+// transaction, so a failing migration leaves no trace
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, mig Migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	script, record, args := mig.Down, "DELETE FROM schema_migrations WHERE version = $1", []any{mig.Version}
+	if up {
+		script, record, args = mig.Up, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", []any{mig.Version, mig.Name}
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	upperDB "github.com/upper/db/v4"
+)
+
+// ErrInvalidActivationToken ...
+var ErrInvalidActivationToken = errors.New("The activation link is invalid, expired or has already been used")
+
+// ActivationTokensModel stores the single-use tokens emailed to new users.
+// Tokens are stored as an HMAC signed with the application secret, so a
+// leaked table cannot be used to activate accounts.
+type ActivationTokensModel struct {
+	db     upperDB.Session
+	secret []byte
+}
+
+// Table ...
+func (am ActivationTokensModel) Table() string {
+	return "activation_tokens"
+}
+
+// New replaces any pending activation token of the user with a new one and
+// returns its plain text along with its expiry
+func (am ActivationTokensModel) New(userID int, ttl time.Duration) (string, time.Time, error) {
+	plain, err := generateToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiry := time.Now().Add(ttl)
+
+	err = am.db.Tx(func(tx upperDB.Session) error {
+		col := tx.Collection(am.Table())
+		if err := col.Find(upperDB.Cond{"user_id": userID}).Delete(); err != nil {
+			return err
+		}
+		_, err := col.Insert(map[string]interface{}{
+			"token_hash": signToken(am.secret, plain),
+			"user_id":    userID,
+			"expiry":     expiry,
+		})
+		return err
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return plain, expiry, nil
+}
+
+// Activate consumes the token and activates the account it was issued for
+func (am ActivationTokensModel) Activate(plain string) (*Users, error) {
+	var user Users
+	err := am.db.Tx(func(tx upperDB.Session) error {
+		// deleting the row is what makes the token single-use
+		row, err := tx.SQL().QueryRow(`DELETE FROM activation_tokens
+			WHERE token_hash = $1 AND expiry > NOW()
+			RETURNING user_id`, signToken(am.secret, plain))
+		if err != nil {
+			return err
+		}
+		var userID int
+		if err := row.Scan(&userID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrInvalidActivationToken
+			}
+			return err
+		}
+
+		if _, err := tx.SQL().Exec("UPDATE users SET activated = true WHERE id = $1", userID); err != nil {
+			return err
+		}
+		if err := tx.Collection(am.Table()).Find(upperDB.Cond{"user_id": userID}).Delete(); err != nil {
+			return err
+		}
+		return tx.Collection("users").Find(upperDB.Cond{"id": userID}).One(&user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
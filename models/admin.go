@@ -0,0 +1,126 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	upperDB "github.com/upper/db/v4"
+)
+
+// AdminUser is a row of the users table of the admin dashboard
+type AdminUser struct {
+	Users        `db:",inline"`
+	PostCount    int `db:"post_count"`
+	CommentCount int `db:"comment_count"`
+	TotalRecords int `db:"total_records"`
+}
+
+// AdminComment is a row of the comments table of the admin dashboard
+type AdminComment struct {
+	ID           int       `db:"id"`
+	CreatedAt    time.Time `db:"created_at"`
+	Body         string    `db:"body"`
+	PostID       int       `db:"post_id"`
+	PostTitle    string    `db:"post_title"`
+	UserID       int       `db:"user_id"`
+	Username     string    `db:"username"`
+	TotalRecords int       `db:"total_records"`
+}
+
+// DayStats counts what happened on a day
+type DayStats struct {
+	Day     time.Time `db:"day"`
+	Signups int       `db:"signups"`
+	Posts   int       `db:"posts"`
+	Votes   int       `db:"votes"` // Votes counts the votes on both posts and comments
+}
+
+// AdminModel runs the queries of the admin dashboard
+type AdminModel struct {
+	db upperDB.Session
+}
+
+// ListUsers lists the users, newest first. f.Query matches part of their
+// username or email.
+func (am AdminModel) ListUsers(f Filters) ([]AdminUser, MetaData, error) {
+	var users []AdminUser
+	var args queryArgs
+	where := ""
+	if f.searching() {
+		pattern := args.add(likePattern(f.Query))
+		where = fmt.Sprintf("WHERE u.username ILIKE %s OR u.email ILIKE %s", pattern, pattern)
+	}
+	query := fmt.Sprintf(`SELECT COUNT(*) OVER() AS total_records, u.id, u.username, u.email, u.activated,
+			u.created_at, u.role, u.banned_at, u.ban_reason, u.totp_enabled_at,
+			(SELECT COUNT(*) FROM posts p WHERE p.user_id = u.id AND p.deleted_at IS NULL) AS post_count,
+			(SELECT COUNT(*) FROM comments c WHERE c.user_id = u.id AND c.deleted_at IS NULL) AS comment_count
+		FROM users u
+		%s
+		ORDER BY u.id DESC
+		LIMIT %s OFFSET %s`, where, args.add(f.limit()), args.add(f.offset()))
+
+	if err := am.query(&users, query, args...); err != nil {
+		return nil, MetaData{}, err
+	}
+	if len(users) == 0 {
+		return nil, MetaData{}, nil
+	}
+	return users, calculateMetaData(users[0].TotalRecords, f.Page, f.PageSize), nil
+}
+
+// ListComments lists the comments that aren't deleted, newest first.
+// f.Query is a full text search of their body or the username of an author.
+func (am AdminModel) ListComments(f Filters) ([]AdminComment, MetaData, error) {
+	var comments []AdminComment
+	var args queryArgs
+	conds := []string{"c.deleted_at IS NULL", "p.deleted_at IS NULL"}
+	if f.searching() {
+		q := args.add(f.Query)
+		conds = append(conds, fmt.Sprintf("(c.search_vector @@ websearch_to_tsquery('english', %s) OR lower(u.username) = lower(%s))", q, q))
+	}
+	query := fmt.Sprintf(`SELECT COUNT(*) OVER() AS total_records, c.id, c.created_at, c.body, c.post_id,
+			p.title AS post_title, c.user_id, u.username
+		FROM comments c
+		JOIN posts p ON p.id = c.post_id
+		JOIN users u ON u.id = c.user_id
+		WHERE %s
+		ORDER BY c.id DESC
+		LIMIT %s OFFSET %s`, strings.Join(conds, " AND "), args.add(f.limit()), args.add(f.offset()))
+
+	if err := am.query(&comments, query, args...); err != nil {
+		return nil, MetaData{}, err
+	}
+	if len(comments) == 0 {
+		return nil, MetaData{}, nil
+	}
+	return comments, calculateMetaData(comments[0].TotalRecords, f.Page, f.PageSize), nil
+}
+
+// DailyStats counts the signups, posts and votes of each of the last days,
+// today first
+func (am AdminModel) DailyStats(days int) ([]DayStats, error) {
+	var stats []DayStats
+	err := am.query(&stats, `SELECT d::date AS day,
+			(SELECT COUNT(*) FROM users WHERE created_at >= d AND created_at < d + INTERVAL '1 day') AS signups,
+			(SELECT COUNT(*) FROM posts WHERE created_at >= d AND created_at < d + INTERVAL '1 day') AS posts,
+			(SELECT COUNT(*) FROM votes WHERE created_at >= d AND created_at < d + INTERVAL '1 day') +
+			(SELECT COUNT(*) FROM comment_votes WHERE created_at >= d AND created_at < d + INTERVAL '1 day') AS votes
+		FROM generate_series((CURRENT_DATE - ($1::int - 1))::timestamptz, CURRENT_DATE::timestamptz, INTERVAL '1 day') AS d
+		ORDER BY day DESC`, days)
+	return stats, err
+}
+
+func (am AdminModel) query(dst interface{}, query string, args ...interface{}) error {
+	rows, err := am.db.SQL().Query(query, args...)
+	if err != nil {
+		return err
+	}
+	return am.db.SQL().NewIterator(rows).All(dst)
+}
+
+// likePattern matches text containing s, with the wildcards of s escaped
+func likePattern(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.TrimSpace(s))
+	return "%" + s + "%"
+}
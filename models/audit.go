@@ -0,0 +1,243 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	upperDB "github.com/upper/db/v4"
+)
+
+// Actions of the audit events
+const (
+	AuditLogin            = "auth.login"
+	AuditLoginFailed      = "auth.login_failed"
+	AuditLogout           = "auth.logout"
+	AuditTwoFactorFailed  = "auth.2fa_failed"
+	AuditAccountLockout   = "auth.account_lockout"
+	AuditSignup           = "auth.signup"
+	AuditActivate         = "auth.activate"
+	AuditPasswordReset    = "auth.password_reset"
+	AuditPasswordChange   = "account.password_change"
+	AuditEmailChangeAsk   = "account.email_change_request"
+	AuditEmailChange      = "account.email_change"
+	AuditUsernameChange   = "account.username_change"
+	AuditSessionRevoke    = "account.session_revoke"
+	AuditSessionsRevoke   = "account.sessions_revoke_others"
+	AuditTwoFactorEnable  = "account.2fa_enable"
+	AuditTwoFactorDisable = "account.2fa_disable"
+	AuditRecoveryCodes    = "account.2fa_recovery_codes"
+	AuditTokenCreate      = "api_token.create"
+	AuditTokenRevoke      = "api_token.revoke"
+	AuditPostDelete       = "post.delete"
+	AuditCommentDelete    = "comment.delete"
+	AuditReportCreate     = "report.create"
+	AuditReportResolve    = "mod.report_resolve"
+	AuditRevisionRestore  = "mod.revision_restore"
+	AuditPostRemove       = "mod.post_remove"
+	AuditPostLock         = "mod.post_lock"
+	AuditPostUnlock       = "mod.post_unlock"
+	AuditPostRetitle      = "mod.post_retitle"
+	AuditCommentRemove    = "mod.comment_remove"
+	AuditUserRole         = "admin.user_role"
+	AuditUserActivate     = "admin.user_activate"
+	AuditUserDeactivate   = "admin.user_deactivate"
+	AuditUserBan          = "admin.user_ban"
+	AuditUserUnban        = "admin.user_unban"
+	AuditTwoFactorReset   = "admin.user_2fa_reset"
+	AuditRolePromoteByCLI = "admin.cli_promote"
+)
+
+// AuditActions lists every action, for filtering the audit log
+var AuditActions = []string{
+	AuditLogin, AuditLoginFailed, AuditAccountLockout, AuditLogout, AuditSignup, AuditActivate,
+	AuditPasswordReset, AuditPasswordChange, AuditEmailChangeAsk, AuditEmailChange, AuditUsernameChange,
+	AuditSessionRevoke, AuditSessionsRevoke, AuditTwoFactorFailed, AuditTwoFactorEnable,
+	AuditTwoFactorDisable, AuditRecoveryCodes,
+	AuditTokenCreate, AuditTokenRevoke, AuditPostDelete, AuditCommentDelete, AuditReportCreate,
+	AuditReportResolve, AuditRevisionRestore, AuditPostRemove, AuditPostLock, AuditPostUnlock,
+	AuditPostRetitle, AuditCommentRemove, AuditUserRole, AuditUserActivate, AuditUserDeactivate,
+	AuditUserBan, AuditUserUnban, AuditTwoFactorReset, AuditRolePromoteByCLI,
+}
+
+// AuditMetadata holds the details of an event, it is stored as jsonb
+type AuditMetadata map[string]interface{}
+
+// Value ...
+func (m AuditMetadata) Value() (driver.Value, error) {
+	if m == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(m)
+	return string(b), err
+}
+
+// Scan ...
+func (m *AuditMetadata) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	case nil:
+		*m = nil
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into AuditMetadata", src)
+	}
+	return json.Unmarshal(data, m)
+}
+
+// AuditEvent is a row of the append-only audit_events table. ActorID is nil
+// for anonymous requests such as failed logins and TargetID when the event
+// has no target.
+type AuditEvent struct {
+	ID           int           `db:"id,omitempty" json:"id"`
+	CreatedAt    time.Time     `db:"created_at,omitempty" json:"created_at"`
+	ActorID      *int          `db:"actor_id" json:"actor_id"`
+	ActorName    string        `db:"actor_name" json:"actor_name,omitempty"`
+	Action       string        `db:"action" json:"action"`
+	TargetType   string        `db:"target_type" json:"target_type,omitempty"`
+	TargetID     *int          `db:"target_id" json:"target_id,omitempty"`
+	IP           string        `db:"ip" json:"ip,omitempty"`
+	UserAgent    string        `db:"user_agent" json:"user_agent,omitempty"`
+	Metadata     AuditMetadata `db:"metadata" json:"metadata,omitempty"`
+	TotalRecords int           `db:"total_records,omitempty" json:"-"`
+}
+
+// AuditDateLayout is how the dates bounding the audit log are written in
+// the admin viewer and the export command
+const AuditDateLayout = "2006-01-02"
+
+// AuditFilters narrows down the audit log, zero values don't filter
+type AuditFilters struct {
+	Filters
+	Action     string
+	Actor      string // Actor is matched against the actor's username
+	TargetType string
+	TargetID   int
+	Since      time.Time
+	Until      time.Time
+}
+
+// Validate ...
+func (f *AuditFilters) Validate() error {
+	if err := f.Filters.Validate(); err != nil {
+		return err
+	}
+	if f.Action != "" && !slices.Contains(AuditActions, f.Action) {
+		return errors.New("Invalid action")
+	}
+	if f.TargetID < 0 {
+		return errors.New("Invalid target")
+	}
+	if !f.Since.IsZero() && !f.Until.IsZero() && !f.Since.Before(f.Until) {
+		return errors.New("Invalid date range")
+	}
+	return nil
+}
+
+// AuditModel ...
+type AuditModel struct {
+	db upperDB.Session
+}
+
+// Record appends an event to the audit log
+func (am AuditModel) Record(e *AuditEvent) error {
+	row, err := am.db.SQL().QueryRow(`INSERT INTO audit_events (actor_id, actor_name, action, target_type, target_id, ip, user_agent, metadata)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8::jsonb)
+		RETURNING id, created_at`,
+		e.ActorID, e.ActorName, e.Action, e.TargetType, e.TargetID, e.IP, e.UserAgent, e.Metadata)
+	if err != nil {
+		return err
+	}
+	return row.Scan(&e.ID, &e.CreatedAt)
+}
+
+// List returns a page of the events matching f, newest first
+func (am AuditModel) List(f AuditFilters) ([]AuditEvent, MetaData, error) {
+	var events []AuditEvent
+	var args queryArgs
+	query := fmt.Sprintf(`SELECT COUNT(*) OVER() AS total_records, %s FROM audit_events %s ORDER BY id DESC LIMIT %s OFFSET %s`,
+		auditColumns, f.where(&args), args.add(f.limit()), args.add(f.offset()))
+
+	rows, err := am.db.SQL().Query(query, args...)
+	if err != nil {
+		return nil, MetaData{}, err
+	}
+	if err := am.db.SQL().NewIterator(rows).All(&events); err != nil {
+		return nil, MetaData{}, err
+	}
+	if len(events) == 0 {
+		return nil, MetaData{}, nil
+	}
+	return events, calculateMetaData(events[0].TotalRecords, f.Page, f.PageSize), nil
+}
+
+// Each calls fn with the events matching f, oldest first, without loading
+// them all in memory. The page of f is ignored.
+func (am AuditModel) Each(f AuditFilters, fn func(*AuditEvent) error) error {
+	var args queryArgs
+	query := fmt.Sprintf(`SELECT %s FROM audit_events %s ORDER BY id`, auditColumns, f.where(&args))
+	rows, err := am.db.SQL().Query(query, args...)
+	if err != nil {
+		return err
+	}
+
+	iter := am.db.SQL().NewIterator(rows)
+	defer iter.Close()
+	for {
+		var e AuditEvent
+		if !iter.Next(&e) {
+			break
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil && !errors.Is(err, upperDB.ErrNoMoreRows) {
+		return err
+	}
+	return nil
+}
+
+const auditColumns = `id, created_at, actor_id, actor_name, action, target_type, target_id, ip, user_agent, metadata`
+
+func (f *AuditFilters) where(args *queryArgs) string {
+	var conds []string
+	if f.Action != "" {
+		conds = append(conds, "action = "+args.add(f.Action))
+	}
+	if f.Actor != "" {
+		conds = append(conds, fmt.Sprintf("lower(actor_name) = lower(%s)", args.add(f.Actor)))
+	}
+	if f.TargetType != "" {
+		conds = append(conds, "target_type = "+args.add(f.TargetType))
+	}
+	if f.TargetID != 0 {
+		conds = append(conds, "target_id = "+args.add(f.TargetID))
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "created_at >= "+args.add(f.Since))
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "created_at < "+args.add(f.Until))
+	}
+	if len(conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conds, " AND ")
+}
+
+// Target describes the target of the event like "post 12"
+func (e *AuditEvent) Target() string {
+	if e.TargetID == nil {
+		return e.TargetType
+	}
+	return fmt.Sprintf("%s %d", e.TargetType, *e.TargetID)
+}
@@ -1,20 +1,90 @@
 package models
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/golang-module/carbon/v2"
 	"github.com/upper/db/v4"
 )
 
+// maxDisplayDepth caps the indentation of deeply nested replies
+const maxDisplayDepth = 10
+
+var (
+	// ErrInvalidParent ...
+	ErrInvalidParent = errors.New("The comment you replied to does not belong to this post")
+
+	// commentsTreeQuery walks the reply tree of a post. Siblings are ranked
+	// by #orderby# and every row carries the path of ranks from its root, so
+	// ordering by path yields each comment directly followed by its replies.
+	commentsTreeQuery = `
+	WITH RECURSIVE scored AS (
+		SELECT c.id, c.created_at, c.edited_at, c.deleted_at, c.hidden_at, c.body, c.post_id, c.user_id, c.parent_id,
+			(s.ups - s.downs)::integer AS score,
+			` + wilsonScore + ` AS wilson
+		FROM comments c
+		LEFT JOIN LATERAL (
+			SELECT COUNT(*) FILTER (WHERE v.value > 0)::numeric AS ups, COUNT(*) FILTER (WHERE v.value < 0)::numeric AS downs
+			FROM comment_votes v
+			WHERE v.comment_id = c.id
+		) s ON true
+		WHERE c.post_id = $1
+	), ranked AS (
+		SELECT sc.*, ROW_NUMBER() OVER (PARTITION BY sc.parent_id ORDER BY #orderby#) AS sibling_rank
+		FROM scored sc
+	), tree AS (
+		SELECT r.*, 0 AS depth, ARRAY[r.sibling_rank] AS path
+		FROM ranked r
+		WHERE r.parent_id IS NULL
+		UNION ALL
+		SELECT r.*, t.depth + 1, t.path || r.sibling_rank
+		FROM ranked r
+		JOIN tree t ON r.parent_id = t.id
+	)
+	SELECT t.id AS comment_id, t.created_at AS comment_created_at, t.edited_at, t.deleted_at, t.hidden_at, t.body, t.post_id, t.user_id, t.parent_id, t.depth, t.score,
+		u.id, u.username, u.created_at
+	FROM tree t
+	JOIN users u ON u.id = t.user_id
+	ORDER BY t.path
+	`
+)
+
+// wilsonScore is the lower bound of the 95% Wilson score interval of the
+// share of upvotes. It ranks a comment with 10 upvotes and 1 downvote above
+// one with a single upvote, which a plain ratio would not.
+const wilsonScore = `CASE WHEN s.ups + s.downs = 0 THEN 0 ELSE
+				((s.ups + 1.9208) / (s.ups + s.downs) - 1.96 * SQRT(s.ups * s.downs / (s.ups + s.downs) + 0.9604) / (s.ups + s.downs))
+				/ (1 + 3.8416 / (s.ups + s.downs))
+			END`
+
+// commentOrderings are the orderings of sibling comments, best is the default
+var commentOrderings = map[string]string{
+	"best": "sc.wilson DESC, sc.score DESC, sc.created_at DESC, sc.id DESC",
+	"top":  "sc.score DESC, sc.created_at DESC, sc.id DESC",
+	"new":  "sc.created_at DESC, sc.id DESC",
+	"old":  "sc.created_at ASC, sc.id ASC",
+}
+
 // Comments ...
 type Comments struct {
-	ID        int       `db:"comment_id,omitempty"`
-	CreatedAt time.Time `db:"comment_created_at,omitempty"`
-	Body      string    `db:"body"`
-	PostID    int       `db:"post_id"`
-	UserID    int       `db:"user_id"`
-	Users     `db:",inline"`
+	ID        int        `db:"comment_id,omitempty" json:"id"`
+	CreatedAt time.Time  `db:"comment_created_at,omitempty" json:"created_at"`
+	EditedAt  *time.Time `db:"edited_at,omitempty" json:"edited_at,omitempty"`
+	DeletedAt *time.Time `db:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	HiddenAt  *time.Time `db:"hidden_at,omitempty" json:"hidden_at,omitempty"`
+	Body      string     `db:"body" json:"body"`
+	PostID    int        `db:"post_id" json:"post_id"`
+	UserID    int        `db:"user_id" json:"user_id"`
+	ParentID  *int       `db:"parent_id,omitempty" json:"parent_id"`
+	Depth     int        `db:"depth,omitempty" json:"depth"` // Depth is 0 for top level comments and grows by one per reply level
+	Score     int        `db:"score,omitempty" json:"score"`
+	// UserVote is the vote of the current user, it is filled in by the handlers
+	UserVote int `db:"-" json:"user_vote,omitempty"`
+	Users    `db:",inline" json:"author"`
 }
 
 // CommentsModel ...
@@ -27,34 +97,352 @@ func (cm CommentsModel) Table() string {
 	return "comments"
 }
 
-// GetCommentsForPost ...
-func (cm CommentsModel) GetCommentsForPost(postID int) ([]Comments, error) {
+// GetCommentsForPost returns the comment tree of a post in display order,
+// i.e. every comment is followed by its replies. Replies to the same comment
+// are sorted by orderBy, one of best, top, new or old.
+func (cm CommentsModel) GetCommentsForPost(postID int, orderBy string) ([]Comments, error) {
 	var comments []Comments
-	query := cm.db.SQL().Select("c.id AS comment_id", "c.created_at AS comment_created_at", "*").From(cm.Table() + " AS c").Join("users AS u").On("c.user_id = u.id").Where(db.Cond{"c.post_id": postID}).OrderBy("c.created_at DESC")
+	ordering, ok := commentOrderings[orderBy]
+	if !ok {
+		ordering = commentOrderings["best"]
+	}
+	rows, err := cm.db.SQL().Query(strings.Replace(commentsTreeQuery, "#orderby#", ordering, 1), postID)
+	if err != nil {
+		return nil, err
+	}
 
-	err := query.All(&comments)
+	iter := cm.db.SQL().NewIterator(rows)
+	err = iter.All(&comments)
 	if err != nil {
 		return nil, err
 	}
+	for i := range comments {
+		if comments[i].IsRedacted() {
+			comments[i].redact()
+		}
+	}
 
 	return comments, nil
 }
 
-// Insert ...
-func (cm CommentsModel) Insert(body string, postID int, userID int) error {
-	_, err := cm.db.Collection(cm.Table()).Insert(map[string]interface{}{
-		"created_at": time.Now(),
+// Insert adds a comment on a post that isn't deleted or locked. A parentID
+// of 0 makes it a top level comment, otherwise it is a reply to that comment
+// of the same post.
+func (cm CommentsModel) Insert(body string, postID, userID, parentID int) (*Comments, error) {
+	comment := Comments{
+		CreatedAt: time.Now(),
+		Body:      body,
+		PostID:    postID,
+		UserID:    userID,
+	}
+	row := map[string]interface{}{
+		"created_at": comment.CreatedAt,
 		"body":       body,
 		"user_id":    userID,
 		"post_id":    postID,
+	}
+	post, err := cm.db.SQL().QueryRow(`SELECT locked_at FROM posts WHERE id = $1 AND deleted_at IS NULL`, postID)
+	if err != nil {
+		return nil, err
+	}
+	var lockedAt *time.Time
+	if err := post.Scan(&lockedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoMoreRows
+		}
+		return nil, err
+	}
+	if lockedAt != nil {
+		return nil, ErrPostLocked
+	}
+	if parentID > 0 {
+		exists, err := cm.db.Collection(cm.Table()).Find(db.Cond{"id": parentID, "post_id": postID, "deleted_at IS": nil}).Exists()
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrInvalidParent
+		}
+		row["parent_id"] = parentID
+		comment.ParentID = &parentID
+	}
+
+	res, err := cm.db.Collection(cm.Table()).Insert(row)
+	if err != nil {
+		return nil, err
+	}
+	comment.ID = convertUpperIDToInt(res.ID())
+	return &comment, nil
+}
+
+// GetByID returns a comment that hasn't been deleted with its score, without
+// its author. Hidden comments are returned too, with HiddenAt set.
+func (cm CommentsModel) GetByID(id int) (*Comments, error) {
+	var comment Comments
+	row, err := cm.db.SQL().QueryRow(`SELECT c.id, c.created_at, c.edited_at, c.hidden_at, c.body, c.post_id, c.user_id, c.parent_id,
+		COALESCE((SELECT SUM(v.value) FROM comment_votes v WHERE v.comment_id = c.id), 0)
+		FROM comments c WHERE c.id = $1 AND c.deleted_at IS NULL`, id)
+	if err != nil {
+		return nil, err
+	}
+	err = row.Scan(&comment.ID, &comment.CreatedAt, &comment.EditedAt, &comment.HiddenAt, &comment.Body, &comment.PostID, &comment.UserID, &comment.ParentID, &comment.Score)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoMoreRows
+		}
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// UserComment is a comment listed on the profile of its author, along with
+// the post it was made on
+type UserComment struct {
+	ID           int        `db:"id"`
+	CreatedAt    time.Time  `db:"created_at"`
+	EditedAt     *time.Time `db:"edited_at"`
+	Body         string     `db:"body"`
+	PostID       int        `db:"post_id"`
+	PostTitle    string     `db:"post_title"`
+	Score        int        `db:"score"`
+	TotalRecords int        `db:"total_records"`
+}
+
+// GetByUser returns a page of the comments of a user, newest first. Deleted
+// and hidden comments and the comments of deleted or hidden posts are left
+// out.
+func (cm CommentsModel) GetByUser(userID int, f Filters) ([]UserComment, MetaData, error) {
+	var comments []UserComment
+	rows, err := cm.db.SQL().Query(`SELECT COUNT(*) OVER() AS total_records, c.id, c.created_at, c.edited_at, c.body, c.post_id,
+			p.title AS post_title, COALESCE((SELECT SUM(v.value) FROM comment_votes v WHERE v.comment_id = c.id), 0) AS score
+		FROM comments c
+		JOIN posts p ON p.id = c.post_id
+		WHERE c.user_id = $1 AND c.deleted_at IS NULL AND c.hidden_at IS NULL AND p.deleted_at IS NULL AND p.hidden_at IS NULL
+		ORDER BY c.created_at DESC, c.id DESC
+		LIMIT $2 OFFSET $3`, userID, f.limit(), f.offset())
+	if err != nil {
+		return nil, MetaData{}, err
+	}
+	if err := cm.db.SQL().NewIterator(rows).All(&comments); err != nil {
+		return nil, MetaData{}, err
+	}
+	if len(comments) == 0 {
+		return nil, MetaData{}, nil
+	}
+	return comments, calculateMetaData(comments[0].TotalRecords, f.Page, f.PageSize), nil
+}
+
+// GetHumanCommentDate ...
+func (c *UserComment) GetHumanCommentDate() string {
+	return carbon.CreateFromStdTime(c.CreatedAt).DiffForHumans()
+}
+
+// SetVote records the vote of a user on a comment, 1 for an upvote, -1 for a
+// downvote and 0 to retract the vote
+func (cm CommentsModel) SetVote(commentID, userID, value int) error {
+	switch value {
+	case 0:
+		_, err := cm.db.SQL().Exec(`DELETE FROM comment_votes WHERE comment_id = $1 AND user_id = $2`, commentID, userID)
+		return err
+	case 1, -1:
+		_, err := cm.db.SQL().Exec(`INSERT INTO comment_votes (comment_id, user_id, value) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, comment_id) DO UPDATE SET value = EXCLUDED.value, created_at = NOW()`, commentID, userID, value)
+		return err
+	default:
+		return ErrInvalidVote
+	}
+}
+
+// GetUserVotes returns the votes of a user on the comments of a post keyed by
+// comment ID
+func (cm CommentsModel) GetUserVotes(userID, postID int) (map[int]int, error) {
+	votes := make(map[int]int)
+	if userID == 0 {
+		return votes, nil
+	}
+	rows, err := cm.db.SQL().Query(`SELECT v.comment_id, v.value FROM comment_votes v
+		JOIN comments c ON c.id = v.comment_id
+		WHERE v.user_id = $1 AND c.post_id = $2`, userID, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, value int
+		if err := rows.Scan(&id, &value); err != nil {
+			return nil, err
+		}
+		votes[id] = value
+	}
+	return votes, rows.Err()
+}
+
+// Update changes the body of a comment, only its author can do so within
+// the edit window
+func (cm CommentsModel) Update(id, userID int, body string, window time.Duration) (*Comments, error) {
+	comment, err := cm.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if comment.UserID != userID {
+		return nil, ErrNotOwner
+	}
+	if !comment.withinEditWindow(window) {
+		return nil, ErrEditWindowClosed
+	}
+	if comment.IsHidden() {
+		return nil, ErrHidden
+	}
+
+	err = cm.db.Tx(func(tx db.Session) error {
+		return editComment(tx, comment, userID, body, window)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cm.GetByID(id)
+}
+
+// Restore makes an old revision the current version of a comment. It is
+// meant for moderators, so there is no ownership or edit window check.
+func (cm CommentsModel) Restore(id, revisionID, editorID int) error {
+	comment, err := cm.GetByID(id)
+	if err != nil {
+		return err
+	}
+	return cm.db.Tx(func(tx db.Session) error {
+		rev, err := getCommentRevision(tx, id, revisionID)
+		if err != nil {
+			return err
+		}
+		return editComment(tx, comment, editorID, rev.Body, 0)
 	})
+}
+
+// editComment is editPost for comments
+func editComment(tx db.Session, comment *Comments, editorID int, body string, window time.Duration) error {
+	var args queryArgs
+	query := fmt.Sprintf(`UPDATE comments SET body = %s, edited_at = NOW() WHERE id = %s AND deleted_at IS NULL`,
+		args.add(body), args.add(comment.ID))
+	if window > 0 {
+		query += fmt.Sprintf(" AND user_id = %s AND created_at >= %s AND hidden_at IS NULL", args.add(editorID), args.add(time.Now().Add(-window)))
+	}
+	res, err := tx.SQL().Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(res); err != nil {
+		return err
+	}
+	return recordCommentRevision(tx, comment, editorID, body)
+}
+
+// Delete soft deletes a comment. Its replies stay in place and it is shown
+// as "[deleted]". Only its author can delete it.
+func (cm CommentsModel) Delete(id, userID int) (*Comments, error) {
+	comment, err := cm.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if comment.UserID != userID {
+		return nil, ErrNotOwner
+	}
+	res, err := cm.db.SQL().Exec(`UPDATE comments SET deleted_at = NOW() WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL`, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAffected(res); err != nil {
+		return nil, err
+	}
+	return comment, nil
+}
+
+// Remove soft deletes a comment whoever its author is, it is meant for moderators
+func (cm CommentsModel) Remove(id int) error {
+	res, err := cm.db.SQL().Exec(`UPDATE comments SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL`, id)
 	if err != nil {
 		return err
 	}
-	return nil
+	return requireAffected(res)
+}
+
+// CanEdit reports whether the user may still edit the comment
+func (c *Comments) CanEdit(userID int, window time.Duration) bool {
+	return c.CanDelete(userID) && c.withinEditWindow(window)
+}
+
+// CanDelete ...
+func (c *Comments) CanDelete(userID int) bool {
+	return userID != 0 && c.UserID == userID && !c.IsRedacted()
+}
+
+func (c *Comments) withinEditWindow(window time.Duration) bool {
+	return time.Since(c.CreatedAt) <= window
+}
+
+// IsEdited ...
+func (c *Comments) IsEdited() bool {
+	return c.EditedAt != nil
+}
+
+// IsDeleted ...
+func (c *Comments) IsDeleted() bool {
+	return c.DeletedAt != nil
+}
+
+// GetHumanEditDate gives the last edit like "10 minutes ago"
+func (c *Comments) GetHumanEditDate() string {
+	if c.EditedAt == nil {
+		return ""
+	}
+	return carbon.CreateFromStdTime(*c.EditedAt).DiffForHumans()
+}
+
+// IsHidden tells whether the comment is hidden until a moderator reviews
+// its reports
+func (c *Comments) IsHidden() bool {
+	return c.HiddenAt != nil
+}
+
+// IsRedacted tells whether the body and author of the comment are hidden
+// from everyone, which is the case for deleted and hidden comments
+func (c *Comments) IsRedacted() bool {
+	return c.IsDeleted() || c.IsHidden()
+}
+
+// redact hides the body and author of a deleted or hidden comment
+func (c *Comments) redact() {
+	c.Body = ""
+	c.UserID = 0
+	c.Users = Users{}
+	c.EditedAt = nil
+}
+
+// Upvoted ...
+func (c *Comments) Upvoted() bool {
+	return c.UserVote > 0
+}
+
+// Downvoted ...
+func (c *Comments) Downvoted() bool {
+	return c.UserVote < 0
 }
 
 // GetHumanCommentDate ...
 func (c *Comments) GetHumanCommentDate() string {
 	return carbon.CreateFromStdTime(c.CreatedAt).DiffForHumans()
 }
+
+// CommentID returns the comment's own ID. Templates must use it instead of
+// .ID, which jet resolves to the ID of the embedded Users struct.
+func (c *Comments) CommentID() int {
+	return c.ID
+}
+
+// Indent returns how many levels the comment is indented when displayed
+func (c *Comments) Indent() int {
+	if c.Depth > maxDisplayDepth {
+		return maxDisplayDepth
+	}
+	return c.Depth
+}
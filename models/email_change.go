@@ -0,0 +1,103 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	upperDB "github.com/upper/db/v4"
+)
+
+// ErrInvalidEmailChangeToken ...
+var ErrInvalidEmailChangeToken = errors.New("The email confirmation link is invalid, expired or has already been used")
+
+// EmailChangesModel stores the single-use tokens sent to a new email
+// address, signed like the activation tokens. The address only replaces the
+// old one once its token is used.
+type EmailChangesModel struct {
+	db     upperDB.Session
+	secret []byte
+}
+
+// Table ...
+func (em EmailChangesModel) Table() string {
+	return "email_change_tokens"
+}
+
+// New replaces any pending email change of the user with one to newEmail and
+// returns the plain token along with its expiry. It fails with
+// ErrDuplicateEmail when another account already uses newEmail.
+func (em EmailChangesModel) New(userID int, newEmail string, ttl time.Duration) (string, time.Time, error) {
+	plain, err := generateToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiry := time.Now().Add(ttl)
+
+	err = em.db.Tx(func(tx upperDB.Session) error {
+		taken, err := tx.Collection("users").Find(upperDB.Cond{"email": newEmail, "id <>": userID}).Exists()
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrDuplicateEmail
+		}
+
+		col := tx.Collection(em.Table())
+		if err := col.Find(upperDB.Cond{"user_id": userID}).Delete(); err != nil {
+			return err
+		}
+		_, err = col.Insert(map[string]interface{}{
+			"token_hash": signToken(em.secret, plain),
+			"user_id":    userID,
+			"new_email":  newEmail,
+			"expiry":     expiry,
+		})
+		return err
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return plain, expiry, nil
+}
+
+// Confirm consumes the token and sets the new email of its user. It returns
+// the updated user and their previous email.
+func (em EmailChangesModel) Confirm(plain string) (*Users, string, error) {
+	var user Users
+	var oldEmail string
+	err := em.db.Tx(func(tx upperDB.Session) error {
+		row, err := tx.SQL().QueryRow(`DELETE FROM email_change_tokens
+			WHERE token_hash = $1 AND expiry > NOW()
+			RETURNING user_id, new_email`, signToken(em.secret, plain))
+		if err != nil {
+			return err
+		}
+		var userID int
+		var newEmail string
+		if err := row.Scan(&userID, &newEmail); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrInvalidEmailChangeToken
+			}
+			return err
+		}
+
+		users := tx.Collection("users").Find(upperDB.Cond{"id": userID})
+		if err := users.One(&user); err != nil {
+			return err
+		}
+		oldEmail = user.Email
+		if err := users.Update(upperDB.Cond{"email": newEmail}); err != nil {
+			if errHasDuplicate(err, usersEmailIndex) {
+				return ErrDuplicateEmail
+			}
+			return err
+		}
+		user.Email = newEmail
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &user, oldEmail, nil
+}
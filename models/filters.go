@@ -2,16 +2,51 @@ package models
 
 import (
 	"errors"
+	"fmt"
 	"math"
+	"slices"
 	"strings"
 )
 
+// headlineStart and headlineStop delimit the matched words in the headlines
+// returned by ts_headline. They are control characters rather than HTML tags
+// so the text can be escaped before the <mark> tags are put in their place.
+const (
+	headlineStart = "\x02"
+	headlineStop  = "\x03"
+)
+
+var headlineOptions = fmt.Sprintf("StartSel=%s, StopSel=%s, MaxWords=30, MinWords=10", headlineStart, headlineStop)
+
+// hotScore ranks posts by their votes and comments, decayed by their age in
+// hours so new posts with a few votes rise above old posts with many
+const hotScore = `(vv.votes + cc.comment_count / 2.0) / POWER(EXTRACT(EPOCH FROM NOW() - p.created_at) / 3600 + 2, 1.8)`
+
+// topWindows are the time windows of the top ordering, "all" adds no limit
+var topWindows = map[string]string{
+	"day":   "1 day",
+	"week":  "7 days",
+	"month": "1 month",
+	"year":  "1 year",
+	"all":   "",
+}
+
+// orderings lists the valid values of OrderBy, popular is the old name of top
+var orderings = []string{"", "latest", "hot", "top", "popular", "relevance"}
+
 // Filters ...
 type Filters struct {
 	Page     int
 	PageSize int
 	OrderBy  string
 	Query    string
+	// Window limits the top ordering to the posts of the last day, week, month
+	// or year, it defaults to all
+	Window string
+	// Author limits the posts to those submitted by this username
+	Author string
+	// SearchComments makes Query also match posts by the text of their comments
+	SearchComments bool
 }
 
 // MetaData ...
@@ -25,6 +60,15 @@ type MetaData struct {
 	TotalRecords int // TotalRecords is the total number of records across all pages
 }
 
+// queryArgs collects the arguments of a query while it is being built
+type queryArgs []interface{}
+
+// add appends an argument and returns its placeholder
+func (q *queryArgs) add(v interface{}) string {
+	*q = append(*q, v)
+	return fmt.Sprintf("$%d", len(*q))
+}
+
 // Validate ...
 func (f *Filters) Validate() error {
 	if f.Page <= 0 || f.Page >= 10_000_000 {
@@ -33,38 +77,95 @@ func (f *Filters) Validate() error {
 	if f.PageSize <= 0 || f.PageSize > 100 {
 		return errors.New("Invalid page size")
 	}
+	if !slices.Contains(orderings, f.OrderBy) {
+		return errors.New("Invalid order")
+	}
+	if _, ok := topWindows[f.Window]; f.Window != "" && !ok {
+		return errors.New("Invalid time window")
+	}
 	return nil
 }
 
+func (f *Filters) searching() bool {
+	return len(strings.TrimSpace(f.Query)) > 0
+}
+
+// orderBy is f.OrderBy with its alias resolved, "popular" is "top"
+func (f *Filters) orderBy() string {
+	if f.OrderBy == "popular" {
+		return "top"
+	}
+	return f.OrderBy
+}
+
 func (f *Filters) addOrdering(query string) string {
-	switch {
-	case f.OrderBy == "popular":
+	switch orderBy := f.orderBy(); {
+	case orderBy == "top":
 		return strings.Replace(query, "#orderby#", "ORDER BY votes DESC, p.created_at DESC", 1)
+	case orderBy == "hot":
+		return strings.Replace(query, "#orderby#", "ORDER BY "+hotScore+" DESC, p.created_at DESC", 1)
+	case orderBy == "relevance" && f.searching():
+		return strings.Replace(query, "#orderby#", "ORDER BY rank DESC, p.created_at DESC", 1)
 	default:
 		return strings.Replace(query, "#orderby#", "ORDER BY p.created_at DESC", 1)
 	}
 }
 
-func (f *Filters) addWhere(query string) string {
-	switch {
-	case len(f.Query) > 0:
-		return strings.Replace(query, "#where#", "WHERE LOWER(p.title) LIKE $1", 1)
-	default:
-		return strings.Replace(query, "#where#", "", 1)
+// addSearch joins the parsed search query as "search" and selects the rank
+// and highlighted headlines of every match
+func (f *Filters) addSearch(query string, args *queryArgs) string {
+	if !f.searching() {
+		query = strings.Replace(query, "#join#", "", 1)
+		return strings.Replace(query, "#select#", "", 1)
 	}
+
+	join := fmt.Sprintf("CROSS JOIN websearch_to_tsquery('english', %s) AS search", args.add(f.Query))
+	opts := args.add(headlineOptions)
+	sel := fmt.Sprintf(", ts_rank(p.search_vector, search) AS rank, ts_headline('english', p.title, search, %s) AS headline", opts)
+	if f.SearchComments {
+		sel += fmt.Sprintf(`, COALESCE((
+			SELECT ts_headline('english', c.body, search, %s)
+			FROM comments c
+			WHERE c.post_id = p.id AND c.deleted_at IS NULL AND c.hidden_at IS NULL AND c.search_vector @@ search
+			ORDER BY ts_rank(c.search_vector, search) DESC
+			LIMIT 1
+		), '') AS snippet`, opts)
+	}
+	query = strings.Replace(query, "#join#", join, 1)
+	return strings.Replace(query, "#select#", sel, 1)
 }
 
-func (f *Filters) addLimitOffset(query string) string {
+func (f *Filters) addWhere(query string, args *queryArgs) string {
+	conds := []string{"p.deleted_at IS NULL", "p.hidden_at IS NULL"}
 	switch {
-	case len(f.Query) > 0:
-		return strings.Replace(query, "#limit#", "LIMIT $2 OFFSET $3", 1) // because then $1 will be the query argument
-	default:
-		return strings.Replace(query, "#limit#", "LIMIT $1 OFFSET $2", 1)
+	case f.searching() && f.SearchComments:
+		conds = append(conds, `(p.search_vector @@ search
+			OR EXISTS (SELECT 1 FROM comments c WHERE c.post_id = p.id AND c.deleted_at IS NULL AND c.hidden_at IS NULL AND c.search_vector @@ search))`)
+	case f.searching():
+		conds = append(conds, "p.search_vector @@ search")
+	}
+	if f.Author != "" {
+		conds = append(conds, fmt.Sprintf("lower(u.username) = lower(%s)", args.add(f.Author)))
 	}
+	if interval := topWindows[f.Window]; f.orderBy() == "top" && interval != "" {
+		conds = append(conds, fmt.Sprintf("p.created_at > NOW() - %s::interval", args.add(interval)))
+	}
+	return strings.Replace(query, "#where#", "WHERE "+strings.Join(conds, " AND "), 1)
+}
+
+func (f *Filters) addLimitOffset(query string, args *queryArgs) string {
+	return strings.Replace(query, "#limit#", fmt.Sprintf("LIMIT %s OFFSET %s", args.add(f.limit()), args.add(f.offset())), 1)
 }
 
-func (f *Filters) applyTemplate(query string) string {
-	return f.addLimitOffset(f.addWhere(f.addOrdering(query)))
+// applyTemplate fills the placeholders of a posts query template and returns
+// the query along with its arguments
+func (f *Filters) applyTemplate(query string) (string, []interface{}) {
+	var args queryArgs
+	query = f.addSearch(query, &args)
+	query = f.addWhere(query, &args)
+	query = f.addOrdering(query)
+	query = f.addLimitOffset(query, &args)
+	return query, args
 }
 
 func (f *Filters) limit() int {
@@ -0,0 +1,156 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	upperDB "github.com/upper/db/v4"
+)
+
+// ErrLoginThrottled ...
+var ErrLoginThrottled = errors.New("Too many failed logins")
+
+// LoginPolicy is how the failed logins counted under a key are throttled,
+// see config.LoginConfig
+type LoginPolicy struct {
+	FreeAttempts int
+	BackoffBase  time.Duration
+	BackoffMax   time.Duration
+	Window       time.Duration
+	// LockoutAttempts is 0 for keys that are never locked out
+	LockoutAttempts int
+	LockoutDuration time.Duration
+}
+
+// Backoff is how long a key waits after its nth failure. It is 0 within
+// the free attempts and doubles with every failure after them.
+func (p LoginPolicy) Backoff(n int) time.Duration {
+	if n <= p.FreeAttempts {
+		return 0
+	}
+	wait := p.BackoffBase
+	for i := p.FreeAttempts + 1; i < n && wait < p.BackoffMax; i++ {
+		wait *= 2
+	}
+	return min(wait, p.BackoffMax)
+}
+
+// LocksOut reports whether the nth failure locks the key out, which happens
+// again every LockoutAttempts failures
+func (p LoginPolicy) LocksOut(n int) bool {
+	return p.LockoutAttempts > 0 && n%p.LockoutAttempts == 0
+}
+
+// LoginThrottle is a row of the login_throttles table
+type LoginThrottle struct {
+	Key           string     `db:"key"`
+	Failures      int        `db:"failures"`
+	LastFailureAt time.Time  `db:"last_failure_at"`
+	BlockedUntil  *time.Time `db:"blocked_until"`
+	NotifiedAt    *time.Time `db:"notified_at"`
+}
+
+// LoginThrottlesModel counts the failed logins of the accounts and of the
+// IP addresses, so password guesses get slower and slower
+type LoginThrottlesModel struct {
+	db upperDB.Session
+}
+
+// Table ...
+func (lm LoginThrottlesModel) Table() string {
+	return "login_throttles"
+}
+
+// Attempt counts a login attempt under key as failed before its password
+// or code is checked, so concurrent attempts can't get past p. It returns
+// until when the next attempt has to wait, the zero time when it doesn't,
+// and whether this one locked the key out, which only matter once the
+// attempt really failed. While the key has to wait the attempt isn't
+// counted and Attempt fails with ErrLoginThrottled, returning until when.
+// Keys without an attempt for longer than the window of p are forgotten on
+// the way.
+func (lm LoginThrottlesModel) Attempt(key string, p LoginPolicy) (time.Time, bool, error) {
+	var until time.Time
+	var lockedOut bool
+	err := lm.db.Tx(func(tx upperDB.Session) error {
+		_, err := tx.SQL().Exec(`DELETE FROM login_throttles
+			WHERE last_failure_at < $1 AND (blocked_until IS NULL OR blocked_until < NOW())`, time.Now().Add(-p.Window))
+		if err != nil {
+			return err
+		}
+
+		// a blocked key matches no row to update, its row stays locked until
+		// the end of the transaction either way
+		row, err := tx.SQL().QueryRow(`INSERT INTO login_throttles (key, failures, last_failure_at) VALUES ($1, 1, NOW())
+			ON CONFLICT (key) DO UPDATE SET failures = login_throttles.failures + 1, last_failure_at = NOW()
+			WHERE login_throttles.blocked_until IS NULL OR login_throttles.blocked_until <= NOW()
+			RETURNING failures`, key)
+		if err != nil {
+			return err
+		}
+		var failures int
+		if err := row.Scan(&failures); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			var t LoginThrottle
+			if err := tx.Collection(lm.Table()).Find(upperDB.Cond{"key": key}).One(&t); err != nil {
+				return err
+			}
+			until = *t.BlockedUntil
+			return ErrLoginThrottled
+		}
+
+		wait := p.Backoff(failures)
+		if p.LocksOut(failures) {
+			lockedOut = true
+			wait = max(wait, p.LockoutDuration)
+		}
+		if wait == 0 {
+			return nil
+		}
+		// blocked_until keeps microseconds, so Refund can match it exactly
+		until = time.Now().Add(wait).Truncate(time.Microsecond)
+		return tx.Collection(lm.Table()).Find(upperDB.Cond{"key": key}).Update(upperDB.Cond{"blocked_until": until})
+	})
+	if err != nil {
+		if errors.Is(err, ErrLoginThrottled) {
+			return until, false, err
+		}
+		return time.Time{}, false, err
+	}
+	return until, lockedOut, nil
+}
+
+// Refund takes back an attempt counted by Attempt, which succeeded or was
+// refused under another key. until is what Attempt returned: the block the
+// attempt set is lifted too, unless a later failure replaced it. Any block
+// before the attempt had run out, or it would have been refused.
+func (lm LoginThrottlesModel) Refund(key string, until time.Time) error {
+	var blocked interface{}
+	if !until.IsZero() {
+		blocked = until
+	}
+	_, err := lm.db.SQL().Exec(`UPDATE login_throttles SET failures = failures - 1,
+			blocked_until = CASE WHEN blocked_until = $2 THEN NULL ELSE blocked_until END
+		WHERE key = $1 AND failures > 0`, key, blocked)
+	return err
+}
+
+// Notify reports whether the owner of key should be told that it got locked
+// out, which they are at most once per window
+func (lm LoginThrottlesModel) Notify(key string, window time.Duration) (bool, error) {
+	res, err := lm.db.SQL().Exec(`UPDATE login_throttles SET notified_at = NOW()
+		WHERE key = $1 AND (notified_at IS NULL OR notified_at < $2)`, key, time.Now().Add(-window))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Clear forgets the attempts counted under key, after a successful login
+func (lm LoginThrottlesModel) Clear(key string) error {
+	return lm.db.Collection(lm.Table()).Find(upperDB.Cond{"key": key}).Delete()
+}
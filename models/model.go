@@ -1,21 +1,44 @@
 package models
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 
 	upperDB "github.com/upper/db/v4"
 )
 
+var (
+	// ErrNotOwner ...
+	ErrNotOwner = errors.New("You can only change what you have written yourself")
+	// ErrEditWindowClosed ...
+	ErrEditWindowClosed = errors.New("It is too late to edit this")
+	// ErrHidden ...
+	ErrHidden = errors.New("This is hidden until a moderator reviews it and can't be edited")
+)
+
 // Models ...
 type Models struct {
-	Users    UsersModel
-	Posts    PostsModel
-	Comments CommentsModel
+	Users          UsersModel
+	Posts          PostsModel
+	Comments       CommentsModel
+	APITokens      APITokensModel
+	Activations    ActivationTokensModel
+	PasswordResets PasswordResetsModel
+	EmailChanges   EmailChangesModel
+	Revisions      RevisionsModel
+	Admin          AdminModel
+	Reports        ReportsModel
+	Audit          AuditModel
+	Sessions       UserSessionsModel
+	TwoFactor      TwoFactorModel
+	LoginThrottles LoginThrottlesModel
 }
 
-// NewModel ...
-func NewModel(db upperDB.Session) Models {
+// NewModel takes the DB session and the application secret used to sign
+// the one-time tokens sent by email
+func NewModel(db upperDB.Session, secret []byte) Models {
 	return Models{
 		Users: UsersModel{
 			db: db,
@@ -26,6 +49,43 @@ func NewModel(db upperDB.Session) Models {
 		Comments: CommentsModel{
 			db: db,
 		},
+		APITokens: APITokensModel{
+			db: db,
+		},
+		Activations: ActivationTokensModel{
+			db:     db,
+			secret: secret,
+		},
+		Revisions: RevisionsModel{
+			db: db,
+		},
+		Admin: AdminModel{
+			db: db,
+		},
+		Reports: ReportsModel{
+			db: db,
+		},
+		Audit: AuditModel{
+			db: db,
+		},
+		Sessions: UserSessionsModel{
+			db: db,
+		},
+		LoginThrottles: LoginThrottlesModel{
+			db: db,
+		},
+		PasswordResets: PasswordResetsModel{
+			db:     db,
+			secret: secret,
+		},
+		EmailChanges: EmailChangesModel{
+			db:     db,
+			secret: secret,
+		},
+		TwoFactor: TwoFactorModel{
+			db:     db,
+			secret: secret,
+		},
 	}
 }
 
@@ -41,3 +101,15 @@ func convertUpperIDToInt(id upperDB.ID) int {
 	}
 	return id.(int)
 }
+
+// requireAffected turns an update that matched no row into ErrNoMoreRows
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoMoreRows
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	upperDB "github.com/upper/db/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidResetToken ...
+var ErrInvalidResetToken = errors.New("The password reset link is invalid, expired or has already been used")
+
+// PasswordResetsModel stores the single-use tokens of the "forgot password"
+// emails, signed like the activation tokens
+type PasswordResetsModel struct {
+	db     upperDB.Session
+	secret []byte
+}
+
+// Table ...
+func (pr PasswordResetsModel) Table() string {
+	return "password_reset_tokens"
+}
+
+// New replaces any pending reset token of the user with a new one and
+// returns its plain text along with its expiry
+func (pr PasswordResetsModel) New(userID int, ttl time.Duration) (string, time.Time, error) {
+	plain, err := generateToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiry := time.Now().Add(ttl)
+
+	err = pr.db.Tx(func(tx upperDB.Session) error {
+		col := tx.Collection(pr.Table())
+		if err := col.Find(upperDB.Cond{"user_id": userID}).Delete(); err != nil {
+			return err
+		}
+		_, err := col.Insert(map[string]interface{}{
+			"token_hash": signToken(pr.secret, plain),
+			"user_id":    userID,
+			"expiry":     expiry,
+		})
+		return err
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return plain, expiry, nil
+}
+
+// Reset consumes the token and sets the new password of its user. The
+// session version is bumped so every existing session of the user is
+// signed out.
+func (pr PasswordResetsModel) Reset(plain, password string) (*Users, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return nil, err
+	}
+
+	var user Users
+	err = pr.db.Tx(func(tx upperDB.Session) error {
+		row, err := tx.SQL().QueryRow(`DELETE FROM password_reset_tokens
+			WHERE token_hash = $1 AND expiry > NOW()
+			RETURNING user_id`, signToken(pr.secret, plain))
+		if err != nil {
+			return err
+		}
+		var userID int
+		if err := row.Scan(&userID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrInvalidResetToken
+			}
+			return err
+		}
+
+		_, err = tx.SQL().Exec(`UPDATE users SET password_hash = $1, session_version = session_version + 1
+			WHERE id = $2`, hash, userID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Collection(pr.Table()).Find(upperDB.Cond{"user_id": userID}).Delete(); err != nil {
+			return err
+		}
+		return tx.Collection("users").Find(upperDB.Cond{"id": userID}).One(&user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -1,9 +1,9 @@
 package models
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
+	"html"
 	"net/url"
 	"strings"
 	"time"
@@ -21,33 +21,52 @@ var (
 	ErrDuplicateVote = errors.New("You have already voted for this post")
 	// ErrDuplicatePost ...
 	ErrDuplicatePost = errors.New("Post with same title already exists")
+	// ErrInvalidVote ...
+	ErrInvalidVote = errors.New("A vote must be 1, 0 or -1")
+	// ErrNotEnoughKarma ...
+	ErrNotEnoughKarma = errors.New("You don't have enough karma to downvote yet")
+	// ErrPostLocked ...
+	ErrPostLocked = errors.New("This post is locked, it can't be commented on")
 
+	// queryTemplate lists posts with their author, score and comment count.
+	// The counts are computed per post so votes and comments don't multiply
+	// each other, the #placeholders# are filled in by Filters.applyTemplate.
 	queryTemplate = `
-	SELECT COUNT(*) OVER() AS total_records, pq.*, u.username AS uname FROM (
-		SELECT p.id, p.title, p.url, p.created_at, p.user_id as uid, COUNT(c.post_id) as comment_count, count(v.post_id) as votes
-		FROM posts p
-		LEFT JOIN comments c ON p.id = c.post_id
-		LEFT JOIN votes v ON p.id = v.post_id
-		#where#
-		GROUP BY p.id
-		#orderby#
-	) AS pq
-	LEFT JOIN users u ON u.id = uid
+	SELECT COUNT(*) OVER() AS total_records, p.id, p.title, p.url, p.created_at, p.edited_at, p.locked_at, p.hidden_at, p.user_id,
+		u.username, cc.comment_count, vv.votes #select#
+	FROM posts p
+	LEFT JOIN users u ON u.id = p.user_id
+	LEFT JOIN LATERAL (SELECT COUNT(*) AS comment_count FROM comments c WHERE c.post_id = p.id AND c.deleted_at IS NULL) cc ON true
+	LEFT JOIN LATERAL (SELECT COALESCE(SUM(v.value), 0) AS votes FROM votes v WHERE v.post_id = p.id) vv ON true
+	#join#
+	#where#
+	#orderby#
 	#limit#
 	`
 )
 
 // Posts is the struct for posts table in DB
 type Posts struct {
-	ID           int       `db:"id,omitempty"`
-	Title        string    `db:"title"`
-	URL          string    `db:"url"`
-	CreatedAt    time.Time `db:"created_at"`
-	UserID       int       `db:"user_id"`
-	Username     string    `db:"username,omitempty"`
-	CommentCount int       `db:"comment_count,omitempty"`
-	TotalRecords int       `db:"total_records,omitempty"`
-	Votes        int       `db:"votes,omitempty"`
+	ID           int        `db:"id,omitempty" json:"id"`
+	Title        string     `db:"title" json:"title"`
+	URL          string     `db:"url" json:"url"`
+	CreatedAt    time.Time  `db:"created_at" json:"created_at"`
+	EditedAt     *time.Time `db:"edited_at,omitempty" json:"edited_at,omitempty"`
+	LockedAt     *time.Time `db:"locked_at,omitempty" json:"locked_at,omitempty"`
+	UserID       int        `db:"user_id" json:"user_id"`
+	Username     string     `db:"username,omitempty" json:"username"`
+	CommentCount int        `db:"comment_count,omitempty" json:"comment_count"`
+	TotalRecords int        `db:"total_records,omitempty" json:"-"`
+	Votes        int        `db:"votes,omitempty" json:"votes"` // Votes is the score, upvotes minus downvotes
+	// UserVote is the vote of the current user, it is filled in by the handlers
+	UserVote int `db:"-" json:"user_vote,omitempty"`
+	// Rank, Headline and Snippet are only set on search results
+	Rank     float64 `db:"rank,omitempty" json:"rank,omitempty"`
+	Headline string  `db:"headline,omitempty" json:"-"`
+	Snippet  string  `db:"snippet,omitempty" json:"-"`
+	// HiddenAt is set once enough reports came in, hidden posts are left out
+	// of the listings until a moderator reviews them
+	HiddenAt *time.Time `db:"hidden_at,omitempty" json:"-"`
 }
 
 // PostsModel ...
@@ -63,9 +82,13 @@ func (pm PostsModel) Table() string {
 // GetByID ...
 func (pm PostsModel) GetByID(id int) (*Posts, error) {
 	var post Posts
-	query := strings.Replace(queryTemplate, "#where#", "WHERE p.id = $1", 1)
-	query = strings.Replace(query, "#orderby#", "", 1)
-	query = strings.Replace(query, "#limit#", "", 1)
+	query := strings.NewReplacer(
+		"#select#", "",
+		"#join#", "",
+		"#where#", "WHERE p.id = $1 AND p.deleted_at IS NULL",
+		"#orderby#", "",
+		"#limit#", "",
+	).Replace(queryTemplate)
 	row, err := pm.db.SQL().Query(query, id)
 	if err != nil {
 		return nil, err
@@ -73,6 +96,9 @@ func (pm PostsModel) GetByID(id int) (*Posts, error) {
 	iter := pm.db.SQL().NewIterator(row)
 	err = iter.One(&post)
 	if err != nil {
+		if errors.Is(err, upperDB.ErrNoMoreRows) {
+			return nil, ErrNoMoreRows
+		}
 		return nil, err
 	}
 	return &post, nil
@@ -81,19 +107,10 @@ func (pm PostsModel) GetByID(id int) (*Posts, error) {
 // GetPosts ...
 func (pm PostsModel) GetPosts(f Filters) ([]Posts, MetaData, error) {
 	var posts []Posts
-	var rows *sql.Rows
-	var err error
 	var meta MetaData
 
-	query := f.applyTemplate(queryTemplate)
-	// fmt.Println("query to be run", query)
-	if len(f.Query) > 0 {
-		// if search post by title
-		rows, err = pm.db.SQL().Query(query, "%"+strings.ToLower(f.Query)+"%", f.limit(), f.offset())
-	} else {
-		// else just display all posts
-		rows, err = pm.db.SQL().Query(query, f.limit(), f.offset())
-	}
+	query, args := f.applyTemplate(queryTemplate)
+	rows, err := pm.db.SQL().Query(query, args...)
 	if err != nil {
 		return nil, meta, err
 	}
@@ -111,21 +128,55 @@ func (pm PostsModel) GetPosts(f Filters) ([]Posts, MetaData, error) {
 	return posts, calculateMetaData(posts[0].TotalRecords, f.Page, f.PageSize), err
 }
 
-// AddVote to vote for a post by a user
-func (pm PostsModel) AddVote(postID, userID int) error {
-	col := pm.db.Collection("votes")
-	_, err := col.Insert(map[string]int{
-		"post_id": postID,
-		"user_id": userID,
-	})
+// SetVote records the vote of a user on a post, 1 for an upvote, -1 for a
+// downvote and 0 to retract the vote
+func (pm PostsModel) SetVote(postID, userID, value int) error {
+	switch value {
+	case 0:
+		_, err := pm.db.SQL().Exec(`DELETE FROM votes WHERE post_id = $1 AND user_id = $2`, postID, userID)
+		return err
+	case 1, -1:
+		_, err := pm.db.SQL().Exec(`INSERT INTO votes (post_id, user_id, value) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, post_id) DO UPDATE SET value = EXCLUDED.value, created_at = NOW()`, postID, userID, value)
+		return err
+	default:
+		return ErrInvalidVote
+	}
+}
+
+// GetVote returns the vote of a user on a post, 0 if they haven't voted
+func (pm PostsModel) GetVote(postID, userID int) (int, error) {
+	var vote struct {
+		Value int `db:"value"`
+	}
+	err := pm.db.Collection("votes").Find(upperDB.Cond{"post_id": postID, "user_id": userID}).One(&vote)
 	if err != nil {
-		fmt.Println("DEBUG: error", err.Error())
-		if errHasDuplicate(err, "votes_pkey") { // you can get this key name by describing the votes table in DB
-			fmt.Println("DEBUG: returning dup error")
-			return ErrDuplicateVote
+		if errors.Is(err, upperDB.ErrNoMoreRows) {
+			return 0, nil
 		}
+		return 0, err
 	}
-	return nil
+	return vote.Value, nil
+}
+
+// GetUserVotes returns the votes of a user on the given posts keyed by post ID
+func (pm PostsModel) GetUserVotes(userID int, postIDs []int) (map[int]int, error) {
+	votes := make(map[int]int)
+	if userID == 0 || len(postIDs) == 0 {
+		return votes, nil
+	}
+	var rows []struct {
+		PostID int `db:"post_id"`
+		Value  int `db:"value"`
+	}
+	err := pm.db.Collection("votes").Find(upperDB.Cond{"user_id": userID, "post_id IN": postIDs}).All(&rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		votes[row.PostID] = row.Value
+	}
+	return votes, nil
 }
 
 // Insert ...
@@ -150,6 +201,176 @@ func (pm PostsModel) Insert(title, url string, userID int) (*Posts, error) {
 	return &post, nil
 }
 
+// Update changes the title and URL of a post, only its author can do so
+// within the edit window
+func (pm PostsModel) Update(id, userID int, title, url string, window time.Duration) (*Posts, error) {
+	post, err := pm.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if post.UserID != userID {
+		return nil, ErrNotOwner
+	}
+	if !post.withinEditWindow(window) {
+		return nil, ErrEditWindowClosed
+	}
+	if post.IsHidden() {
+		return nil, ErrHidden
+	}
+
+	err = pm.db.Tx(func(tx upperDB.Session) error {
+		return editPost(tx, post, userID, title, url, window)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pm.GetByID(id)
+}
+
+// Restore makes an old revision the current version of a post. It is meant
+// for moderators, so there is no ownership or edit window check.
+func (pm PostsModel) Restore(id, revisionID, editorID int) error {
+	post, err := pm.GetByID(id)
+	if err != nil {
+		return err
+	}
+	return pm.db.Tx(func(tx upperDB.Session) error {
+		rev, err := getPostRevision(tx, id, revisionID)
+		if err != nil {
+			return err
+		}
+		return editPost(tx, post, editorID, rev.Title, rev.URL, 0)
+	})
+}
+
+// editPost updates a post that isn't deleted and records the new version in
+// its history. With a window of 0 the editor may change any post, otherwise
+// only the author may, within the window after posting. It fails with
+// ErrNoMoreRows when the post no longer matches. Authors can't edit hidden
+// posts.
+func editPost(tx upperDB.Session, post *Posts, editorID int, title, url string, window time.Duration) error {
+	var args queryArgs
+	query := fmt.Sprintf(`UPDATE posts SET title = %s, url = %s, edited_at = NOW() WHERE id = %s AND deleted_at IS NULL`,
+		args.add(title), args.add(url), args.add(post.ID))
+	if window > 0 {
+		query += fmt.Sprintf(" AND user_id = %s AND created_at >= %s AND hidden_at IS NULL", args.add(editorID), args.add(time.Now().Add(-window)))
+	}
+	res, err := tx.SQL().Exec(query, args...)
+	if err != nil {
+		if errHasDuplicate(err, postsTitleIndex) {
+			return ErrDuplicatePost
+		}
+		return err
+	}
+	if err := requireAffected(res); err != nil {
+		return err
+	}
+	return recordPostRevision(tx, post, editorID, title, url)
+}
+
+// Delete soft deletes a post, which hides it everywhere. Only its author can
+// delete it.
+func (pm PostsModel) Delete(id, userID int) error {
+	post, err := pm.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if post.UserID != userID {
+		return ErrNotOwner
+	}
+	res, err := pm.db.SQL().Exec(`UPDATE posts SET deleted_at = NOW() WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL`, id, userID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// SetTitle changes the title of a post on behalf of a moderator, the change
+// is recorded in the history of the post like any other edit
+func (pm PostsModel) SetTitle(id, editorID int, title string) error {
+	post, err := pm.GetByID(id)
+	if err != nil {
+		return err
+	}
+	return pm.db.Tx(func(tx upperDB.Session) error {
+		return editPost(tx, post, editorID, title, post.URL, 0)
+	})
+}
+
+// SetLocked locks or unlocks a post, locked posts don't take new comments
+func (pm PostsModel) SetLocked(id int, locked bool) error {
+	var lockedAt interface{}
+	if locked {
+		lockedAt = time.Now()
+	}
+	res, err := pm.db.SQL().Exec(`UPDATE posts SET locked_at = $1 WHERE id = $2 AND deleted_at IS NULL`, lockedAt, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// Remove soft deletes a post whoever its author is, it is meant for moderators
+func (pm PostsModel) Remove(id int) error {
+	res, err := pm.db.SQL().Exec(`UPDATE posts SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// IsHidden ...
+func (p *Posts) IsHidden() bool {
+	return p.HiddenAt != nil
+}
+
+// IsLocked ...
+func (p *Posts) IsLocked() bool {
+	return p.LockedAt != nil
+}
+
+// CanEdit reports whether the user may still edit the post
+func (p *Posts) CanEdit(userID int, window time.Duration) bool {
+	return userID != 0 && p.UserID == userID && p.withinEditWindow(window) && !p.IsHidden()
+}
+
+// CanDelete ...
+func (p *Posts) CanDelete(userID int) bool {
+	return userID != 0 && p.UserID == userID
+}
+
+func (p *Posts) withinEditWindow(window time.Duration) bool {
+	return time.Since(p.CreatedAt) <= window
+}
+
+// IsEdited ...
+func (p *Posts) IsEdited() bool {
+	return p.EditedAt != nil
+}
+
+// GetHumanEditDate gives the last edit like "10 minutes ago"
+func (p *Posts) GetHumanEditDate() string {
+	if p.EditedAt == nil {
+		return ""
+	}
+	return carbon.CreateFromStdTime(*p.EditedAt).DiffForHumans()
+}
+
+// Upvoted ...
+func (p *Posts) Upvoted() bool {
+	return p.UserVote > 0
+}
+
+// Downvoted ...
+func (p *Posts) Downvoted() bool {
+	return p.UserVote < 0
+}
+
+// AuthorURL is the path of the public profile of the author
+func (p *Posts) AuthorURL() string {
+	return profileURL(p.Username)
+}
+
 // GetHumanPostDate gives posted date like "10 minutes ago"
 func (p *Posts) GetHumanPostDate() string {
 	return carbon.CreateFromStdTime(p.CreatedAt).DiffForHumans()
@@ -163,3 +384,23 @@ func (p *Posts) GetHost() string {
 	}
 	return u.Host
 }
+
+// HighlightedTitle returns the title as HTML with the words matching the
+// search wrapped in <mark>
+func (p *Posts) HighlightedTitle() string {
+	if p.Headline == "" {
+		return html.EscapeString(p.Title)
+	}
+	return highlight(p.Headline)
+}
+
+// HighlightedSnippet returns the part of a matching comment as HTML, it is
+// empty unless comments were searched
+func (p *Posts) HighlightedSnippet() string {
+	return highlight(p.Snippet)
+}
+
+// highlight escapes a ts_headline result and turns its markers into <mark> tags
+func highlight(headline string) string {
+	return strings.NewReplacer(headlineStart, "<mark>", headlineStop, "</mark>").Replace(html.EscapeString(headline))
+}
@@ -0,0 +1,295 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	upperDB "github.com/upper/db/v4"
+)
+
+const (
+	reportsPostIndex    = "reports_post_reporter_key"
+	reportsCommentIndex = "reports_comment_reporter_key"
+)
+
+// Resolutions of the reports, see ReportsModel.ResolvePost
+const (
+	ResolutionDismissed = "dismissed"
+	ResolutionRemoved   = "removed"
+	ResolutionBanned    = "banned"
+)
+
+var (
+	// ErrDuplicateReport ...
+	ErrDuplicateReport = errors.New("You have already reported this")
+	// ErrInvalidReason ...
+	ErrInvalidReason = errors.New("Pick one of the reasons for the report")
+	// ErrOwnContent ...
+	ErrOwnContent = errors.New("You can't report what you have written yourself")
+	// ErrInvalidResolution ...
+	ErrInvalidResolution = errors.New("A report is dismissed, removed or banned")
+	// ErrBanStaff ...
+	ErrBanStaff = errors.New("Moderators and admins can't be banned from the moderation queue")
+)
+
+// ReportReason is a reason users can pick when reporting something
+type ReportReason struct {
+	Value string
+	Label string
+}
+
+// ReportReasons lists the reasons in the order they are offered
+var ReportReasons = []ReportReason{
+	{"spam", "Spam"},
+	{"abuse", "Abusive or harassing"},
+	{"off_topic", "Off topic"},
+	{"other", "Something else"},
+}
+
+// reportTarget is the table of the reported items and the column of the
+// reports table pointing at it
+type reportTarget struct {
+	kind   string
+	table  string
+	column string
+	index  string
+}
+
+var (
+	postTarget    = reportTarget{"post", "posts", "post_id", reportsPostIndex}
+	commentTarget = reportTarget{"comment", "comments", "comment_id", reportsCommentIndex}
+)
+
+// QueueItem is a post or comment with open reports, PostID is set for posts
+// and CommentID for comments
+type QueueItem struct {
+	PostID          int       `db:"post_id"`
+	CommentID       int       `db:"comment_id"`
+	ThreadID        int       `db:"thread_id"` // ThreadID is the post the item is shown on
+	Title           string    `db:"title"`
+	Body            string    `db:"body"`
+	AuthorID        int       `db:"author_id"`
+	Author          string    `db:"author"`
+	ReportCount     int       `db:"report_count"`
+	Reasons         string    `db:"reasons"`
+	Details         string    `db:"details"`
+	FirstReportedAt time.Time `db:"first_reported_at"`
+	Hidden          bool      `db:"hidden"`
+	TotalRecords    int       `db:"total_records"`
+}
+
+// ResolvedItem is a resolution of the reports of a post or comment
+type ResolvedItem struct {
+	PostID      int       `db:"post_id"`
+	CommentID   int       `db:"comment_id"`
+	ThreadID    int       `db:"thread_id"`
+	ReportCount int       `db:"report_count"`
+	Resolution  string    `db:"resolution"`
+	Resolver    string    `db:"resolver"`
+	ResolvedAt  time.Time `db:"resolved_at"`
+}
+
+// ReportsModel ...
+type ReportsModel struct {
+	db upperDB.Session
+}
+
+// ReportPost records a report on a post. Once hideThreshold reports from
+// accounts older than establishedAge are open, the post is hidden until a
+// moderator reviews it; hidden tells whether that happened.
+func (rm ReportsModel) ReportPost(postID, reporterID int, reason, details string, hideThreshold int, establishedAge time.Duration) (hidden bool, err error) {
+	return rm.report(postTarget, postID, reporterID, reason, details, hideThreshold, establishedAge)
+}
+
+// ReportComment is ReportPost for comments
+func (rm ReportsModel) ReportComment(commentID, reporterID int, reason, details string, hideThreshold int, establishedAge time.Duration) (hidden bool, err error) {
+	return rm.report(commentTarget, commentID, reporterID, reason, details, hideThreshold, establishedAge)
+}
+
+func (rm ReportsModel) report(target reportTarget, itemID, reporterID int, reason, details string, hideThreshold int, establishedAge time.Duration) (bool, error) {
+	if !validReason(reason) {
+		return false, ErrInvalidReason
+	}
+
+	hidden := false
+	err := rm.db.Tx(func(tx upperDB.Session) error {
+		var authorID int
+		row, err := tx.SQL().QueryRow(fmt.Sprintf(`SELECT user_id FROM %s WHERE id = $1 AND deleted_at IS NULL`, target.table), itemID)
+		if err != nil {
+			return err
+		}
+		if err := row.Scan(&authorID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNoMoreRows
+			}
+			return err
+		}
+		if authorID == reporterID {
+			return ErrOwnContent
+		}
+
+		_, err = tx.SQL().Exec(fmt.Sprintf(`INSERT INTO reports (reporter_id, %s, reason, details, established)
+			SELECT $1, $2, $3, $4, u.created_at <= $5 FROM users u WHERE u.id = $1`, target.column),
+			reporterID, itemID, reason, details, time.Now().Add(-establishedAge))
+		if err != nil {
+			if errHasDuplicate(err, target.index) {
+				return ErrDuplicateReport
+			}
+			return err
+		}
+		if hideThreshold <= 0 {
+			return nil
+		}
+
+		res, err := tx.SQL().Exec(fmt.Sprintf(`UPDATE %s SET hidden_at = NOW()
+			WHERE id = $1 AND hidden_at IS NULL AND (
+				SELECT COUNT(*) FROM reports WHERE %s = $1 AND resolved_at IS NULL AND established
+			) >= $2`, target.table, target.column), itemID, hideThreshold)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		hidden = n > 0
+		return err
+	})
+	return hidden, err
+}
+
+// Queue lists the posts and comments with open reports, the most reported
+// first. Items their author deleted in the meantime are left out.
+func (rm ReportsModel) Queue(f Filters) ([]QueueItem, MetaData, error) {
+	var items []QueueItem
+	var args queryArgs
+	query := fmt.Sprintf(`SELECT COUNT(*) OVER() AS total_records,
+			COALESCE(r.post_id, 0) AS post_id, COALESCE(r.comment_id, 0) AS comment_id,
+			COALESCE(c.post_id, r.post_id) AS thread_id,
+			COALESCE(p.title, '') AS title, COALESCE(c.body, '') AS body,
+			u.id AS author_id, u.username AS author,
+			COUNT(*) AS report_count, MIN(r.created_at) AS first_reported_at,
+			string_agg(DISTINCT r.reason, ', ') AS reasons,
+			COALESCE(string_agg(NULLIF(r.details, ''), ' / '), '') AS details,
+			COALESCE(p.hidden_at, c.hidden_at) IS NOT NULL AS hidden
+		FROM reports r
+		LEFT JOIN posts p ON p.id = r.post_id
+		LEFT JOIN comments c ON c.id = r.comment_id
+		JOIN users u ON u.id = COALESCE(p.user_id, c.user_id)
+		WHERE r.resolved_at IS NULL AND COALESCE(p.deleted_at, c.deleted_at) IS NULL
+		GROUP BY r.post_id, r.comment_id, p.id, c.id, u.id
+		ORDER BY report_count DESC, first_reported_at
+		LIMIT %s OFFSET %s`, args.add(f.limit()), args.add(f.offset()))
+
+	if err := rm.query(&items, query, args...); err != nil {
+		return nil, MetaData{}, err
+	}
+	if len(items) == 0 {
+		return nil, MetaData{}, nil
+	}
+	return items, calculateMetaData(items[0].TotalRecords, f.Page, f.PageSize), nil
+}
+
+// RecentlyResolved lists the latest resolutions, newest first
+func (rm ReportsModel) RecentlyResolved(limit int) ([]ResolvedItem, error) {
+	var items []ResolvedItem
+	err := rm.query(&items, `SELECT COALESCE(r.post_id, 0) AS post_id, COALESCE(r.comment_id, 0) AS comment_id,
+			COALESCE(c.post_id, r.post_id) AS thread_id, COUNT(*) AS report_count,
+			r.resolution, r.resolved_at, COALESCE(m.username, '') AS resolver
+		FROM reports r
+		LEFT JOIN comments c ON c.id = r.comment_id
+		LEFT JOIN users m ON m.id = r.resolver_id
+		WHERE r.resolved_at IS NOT NULL
+		GROUP BY r.post_id, r.comment_id, c.post_id, r.resolution, r.resolved_at, m.username
+		ORDER BY r.resolved_at DESC
+		LIMIT $1`, limit)
+	return items, err
+}
+
+// ResolvePost resolves every open report of a post. Dismissing them shows
+// the post again if it was hidden, removed deletes the post and banned also
+// bans its author.
+func (rm ReportsModel) ResolvePost(postID, resolverID int, resolution string) error {
+	return rm.resolve(postTarget, postID, resolverID, resolution)
+}
+
+// ResolveComment is ResolvePost for comments
+func (rm ReportsModel) ResolveComment(commentID, resolverID int, resolution string) error {
+	return rm.resolve(commentTarget, commentID, resolverID, resolution)
+}
+
+func (rm ReportsModel) resolve(target reportTarget, itemID, resolverID int, resolution string) error {
+	switch resolution {
+	case ResolutionDismissed, ResolutionRemoved, ResolutionBanned:
+	default:
+		return ErrInvalidResolution
+	}
+
+	return rm.db.Tx(func(tx upperDB.Session) error {
+		res, err := tx.SQL().Exec(fmt.Sprintf(`UPDATE reports SET resolved_at = NOW(), resolver_id = $1, resolution = $2
+			WHERE %s = $3 AND resolved_at IS NULL`, target.column), resolverID, resolution, itemID)
+		if err != nil {
+			return err
+		}
+		if err := requireAffected(res); err != nil {
+			return err
+		}
+
+		if resolution == ResolutionDismissed {
+			_, err = tx.SQL().Exec(fmt.Sprintf(`UPDATE %s SET hidden_at = NULL WHERE id = $1`, target.table), itemID)
+			return err
+		}
+
+		var author Users
+		row, err := tx.SQL().QueryRow(fmt.Sprintf(`SELECT u.id, u.role FROM users u JOIN %s t ON t.user_id = u.id WHERE t.id = $1`, target.table), itemID)
+		if err != nil {
+			return err
+		}
+		if err := row.Scan(&author.ID, &author.Role); err != nil {
+			return err
+		}
+		if resolution == ResolutionBanned && author.HasRole(RoleModerator) {
+			return ErrBanStaff
+		}
+
+		_, err = tx.SQL().Exec(fmt.Sprintf(`UPDATE %s SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL`, target.table), itemID)
+		if err != nil || resolution != ResolutionBanned {
+			return err
+		}
+		_, err = tx.SQL().Exec(`UPDATE users SET banned_at = NOW(), ban_reason = $1 WHERE id = $2`,
+			fmt.Sprintf("Reported %s %d", target.kind, itemID), author.ID)
+		return err
+	})
+}
+
+func (rm ReportsModel) query(dst interface{}, query string, args ...interface{}) error {
+	rows, err := rm.db.SQL().Query(query, args...)
+	if err != nil {
+		return err
+	}
+	return rm.db.SQL().NewIterator(rows).All(dst)
+}
+
+// Kind is "post" or "comment"
+func (q *QueueItem) Kind() string {
+	if q.CommentID != 0 {
+		return "comment"
+	}
+	return "post"
+}
+
+// Kind is "post" or "comment"
+func (q *ResolvedItem) Kind() string {
+	if q.CommentID != 0 {
+		return "comment"
+	}
+	return "post"
+}
+
+func validReason(reason string) bool {
+	for _, r := range ReportReasons {
+		if r.Value == reason {
+			return true
+		}
+	}
+	return false
+}
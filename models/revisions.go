@@ -0,0 +1,118 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-module/carbon/v2"
+	upperDB "github.com/upper/db/v4"
+)
+
+// Revisions is a row of post_revisions or comment_revisions. Title and URL
+// are only set for posts and Body only for comments.
+type Revisions struct {
+	ID        int       `db:"id" json:"id"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	EditorID  *int      `db:"editor_id" json:"editor_id"`
+	Editor    string    `db:"editor" json:"editor"`
+	Title     string    `db:"title" json:"title,omitempty"`
+	URL       string    `db:"url" json:"url,omitempty"`
+	Body      string    `db:"body" json:"body,omitempty"`
+}
+
+// RevisionsModel ...
+type RevisionsModel struct {
+	db upperDB.Session
+}
+
+// ForPost lists the revisions of a post, oldest first
+func (rm RevisionsModel) ForPost(postID int) ([]Revisions, error) {
+	return rm.query(`SELECT r.id, r.created_at, r.editor_id, COALESCE(u.username, '') AS editor, r.title, r.url, '' AS body
+		FROM post_revisions r
+		LEFT JOIN users u ON u.id = r.editor_id
+		WHERE r.post_id = $1
+		ORDER BY r.id`, postID)
+}
+
+// ForComment lists the revisions of a comment, oldest first
+func (rm RevisionsModel) ForComment(commentID int) ([]Revisions, error) {
+	return rm.query(`SELECT r.id, r.created_at, r.editor_id, COALESCE(u.username, '') AS editor, '' AS title, '' AS url, r.body
+		FROM comment_revisions r
+		LEFT JOIN users u ON u.id = r.editor_id
+		WHERE r.comment_id = $1
+		ORDER BY r.id`, commentID)
+}
+
+func (rm RevisionsModel) query(query string, args ...interface{}) ([]Revisions, error) {
+	var revisions []Revisions
+	rows, err := rm.db.SQL().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	iter := rm.db.SQL().NewIterator(rows)
+	if err := iter.All(&revisions); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// GetHumanDate gives the date of the revision like "10 minutes ago"
+func (r *Revisions) GetHumanDate() string {
+	return carbon.CreateFromStdTime(r.CreatedAt).DiffForHumans()
+}
+
+// recordPostRevision stores the new version of a post edited by editorID.
+// The first edit also stores the original version, so every version of the
+// post can be found in its history.
+func recordPostRevision(tx upperDB.Session, post *Posts, editorID int, title, url string) error {
+	_, err := tx.SQL().Exec(`INSERT INTO post_revisions (created_at, post_id, editor_id, title, url)
+		SELECT $1, $2, $3, $4, $5
+		WHERE NOT EXISTS (SELECT 1 FROM post_revisions WHERE post_id = $2)`,
+		post.CreatedAt, post.ID, post.UserID, post.Title, post.URL)
+	if err != nil {
+		return err
+	}
+	_, err = tx.SQL().Exec(`INSERT INTO post_revisions (post_id, editor_id, title, url) VALUES ($1, $2, $3, $4)`,
+		post.ID, editorID, title, url)
+	return err
+}
+
+// recordCommentRevision is recordPostRevision for comments
+func recordCommentRevision(tx upperDB.Session, comment *Comments, editorID int, body string) error {
+	_, err := tx.SQL().Exec(`INSERT INTO comment_revisions (created_at, comment_id, editor_id, body)
+		SELECT $1, $2, $3, $4
+		WHERE NOT EXISTS (SELECT 1 FROM comment_revisions WHERE comment_id = $2)`,
+		comment.CreatedAt, comment.ID, comment.UserID, comment.Body)
+	if err != nil {
+		return err
+	}
+	_, err = tx.SQL().Exec(`INSERT INTO comment_revisions (comment_id, editor_id, body) VALUES ($1, $2, $3)`,
+		comment.ID, editorID, body)
+	return err
+}
+
+// getPostRevision loads a revision of the post for restoring it
+func getPostRevision(tx upperDB.Session, postID, revisionID int) (*Revisions, error) {
+	var rev Revisions
+	err := tx.Collection("post_revisions").Find(upperDB.Cond{"id": revisionID, "post_id": postID}).One(&rev)
+	if err != nil {
+		if errors.Is(err, upperDB.ErrNoMoreRows) {
+			return nil, ErrNoMoreRows
+		}
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// getCommentRevision loads a revision of the comment for restoring it
+func getCommentRevision(tx upperDB.Session, commentID, revisionID int) (*Revisions, error) {
+	var rev Revisions
+	err := tx.Collection("comment_revisions").Find(upperDB.Cond{"id": revisionID, "comment_id": commentID}).One(&rev)
+	if err != nil {
+		if errors.Is(err, upperDB.ErrNoMoreRows) {
+			return nil, ErrNoMoreRows
+		}
+		return nil, err
+	}
+	return &rev, nil
+}
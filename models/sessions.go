@@ -0,0 +1,113 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-module/carbon/v2"
+	upperDB "github.com/upper/db/v4"
+)
+
+// sessionSeenInterval is how stale last_seen_at may get before a request
+// updates it, so not every request writes to the table
+const sessionSeenInterval = time.Minute
+
+// UserSession is a logged in session of a user
+type UserSession struct {
+	ID         int       `db:"id,omitempty"`
+	UserID     int       `db:"user_id"`
+	CreatedAt  time.Time `db:"created_at,omitempty"`
+	LastSeenAt time.Time `db:"last_seen_at,omitempty"`
+	IP         string    `db:"ip"`
+	UserAgent  string    `db:"user_agent"`
+}
+
+// UserSessionsModel ...
+type UserSessionsModel struct {
+	db upperDB.Session
+}
+
+// Table ...
+func (sm UserSessionsModel) Table() string {
+	return "user_sessions"
+}
+
+// Create records a new session of the user. The sessions of the user older
+// than lifetime, which scs has expired by now, are cleaned up on the way.
+func (sm UserSessionsModel) Create(userID int, ip, userAgent string, lifetime time.Duration) (*UserSession, error) {
+	col := sm.db.Collection(sm.Table())
+	err := col.Find(upperDB.Cond{"user_id": userID, "created_at <": time.Now().Add(-lifetime)}).Delete()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := UserSession{UserID: userID, CreatedAt: now, LastSeenAt: now, IP: ip, UserAgent: userAgent}
+	res, err := col.Insert(&session)
+	if err != nil {
+		return nil, err
+	}
+	session.ID = convertUpperIDToInt(res.ID())
+	return &session, nil
+}
+
+// Seen marks the session as used from ip. It fails with ErrNoMoreRows when
+// the session was revoked.
+func (sm UserSessionsModel) Seen(id, userID int, ip string) error {
+	var session UserSession
+	res := sm.db.Collection(sm.Table()).Find(upperDB.Cond{"id": id, "user_id": userID})
+	if err := res.One(&session); err != nil {
+		if errors.Is(err, upperDB.ErrNoMoreRows) {
+			return ErrNoMoreRows
+		}
+		return err
+	}
+	if time.Since(session.LastSeenAt) < sessionSeenInterval && session.IP == ip {
+		return nil
+	}
+	return res.Update(upperDB.Cond{"last_seen_at": time.Now(), "ip": ip})
+}
+
+// ListForUser returns the sessions of the user younger than lifetime, the
+// most recently used first
+func (sm UserSessionsModel) ListForUser(userID int, lifetime time.Duration) ([]UserSession, error) {
+	var sessions []UserSession
+	err := sm.db.Collection(sm.Table()).
+		Find(upperDB.Cond{"user_id": userID, "created_at >=": time.Now().Add(-lifetime)}).
+		OrderBy("-last_seen_at", "-id").
+		All(&sessions)
+	return sessions, err
+}
+
+// Revoke signs a session of the user out, it fails with ErrNoMoreRows when
+// the user has no such session
+func (sm UserSessionsModel) Revoke(id, userID int) error {
+	res, err := sm.db.SQL().Exec(`DELETE FROM user_sessions WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoMoreRows
+	}
+	return nil
+}
+
+// RevokeOthers signs out every session of the user but keepID, which may be
+// 0 to sign out all of them. It returns how many sessions were signed out.
+func (sm UserSessionsModel) RevokeOthers(userID, keepID int) (int, error) {
+	res, err := sm.db.SQL().Exec(`DELETE FROM user_sessions WHERE user_id = $1 AND id <> $2`, userID, keepID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// GetHumanLastSeen ...
+func (s *UserSession) GetHumanLastSeen() string {
+	return carbon.CreateFromStdTime(s.LastSeenAt).DiffForHumans()
+}
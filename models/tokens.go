@@ -0,0 +1,197 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/golang-module/carbon/v2"
+	upperDB "github.com/upper/db/v4"
+	"github.com/upper/db/v4/adapter/postgresql"
+)
+
+// apiTokenPrefix makes leaked tokens easy to recognise, e.g. by secret scanners
+const apiTokenPrefix = "nwa_"
+
+// Scopes an API token can be granted
+const (
+	ScopeRead    = "read"
+	ScopeSubmit  = "submit"
+	ScopeVote    = "vote"
+	ScopeComment = "comment"
+)
+
+// AllScopes lists every scope in the order they are shown to users
+var AllScopes = []string{ScopeRead, ScopeSubmit, ScopeVote, ScopeComment}
+
+var (
+	// ErrInvalidToken ...
+	ErrInvalidToken = errors.New("Invalid or revoked API token")
+	// ErrInvalidScope ...
+	ErrInvalidScope = errors.New("Unknown API token scope")
+)
+
+// APITokens is the api_tokens table in postgres. Only a hash of the token is
+// stored, the plain text is shown to the user once when it is created.
+type APITokens struct {
+	ID         int                    `db:"id,omitempty" json:"id"`
+	CreatedAt  time.Time              `db:"created_at" json:"created_at"`
+	UserID     int                    `db:"user_id" json:"-"`
+	Name       string                 `db:"name" json:"name"`
+	Hash       []byte                 `db:"token_hash" json:"-"`
+	Scopes     postgresql.StringArray `db:"scopes" json:"scopes"`
+	LastUsedAt *time.Time             `db:"last_used_at,omitempty" json:"last_used_at"`
+}
+
+// APITokensModel ...
+type APITokensModel struct {
+	db upperDB.Session
+}
+
+// Table ...
+func (tm APITokensModel) Table() string {
+	return "api_tokens"
+}
+
+// Insert creates a new token for the user and returns its plain text
+func (tm APITokensModel) Insert(userID int, name string, scopes []string) (string, *APITokens, error) {
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return "", nil, ErrInvalidScope
+		}
+	}
+
+	plain, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	plain = apiTokenPrefix + plain
+	token := APITokens{
+		CreatedAt: time.Now(),
+		UserID:    userID,
+		Name:      name,
+		Hash:      hashToken(plain),
+		Scopes:    scopes,
+	}
+	res, err := tm.db.Collection(tm.Table()).Insert(token)
+	if err != nil {
+		return "", nil, err
+	}
+	token.ID = convertUpperIDToInt(res.ID())
+	return plain, &token, nil
+}
+
+// GetForUser lists the tokens of a user, newest first
+func (tm APITokensModel) GetForUser(userID int) ([]APITokens, error) {
+	var tokens []APITokens
+	err := tm.db.Collection(tm.Table()).Find(upperDB.Cond{"user_id": userID}).OrderBy("-created_at").All(&tokens)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Revoke deletes a token of the user
+func (tm APITokensModel) Revoke(id, userID int) error {
+	res := tm.db.Collection(tm.Table()).Find(upperDB.Cond{"id": id, "user_id": userID})
+	exists, err := res.Exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNoMoreRows
+	}
+	return res.Delete()
+}
+
+// Authenticate looks up the token matching the plain text and records that
+// it has been used. Tokens of banned or inactive users are refused.
+func (tm APITokensModel) Authenticate(plain string) (*APITokens, error) {
+	if !strings.HasPrefix(plain, apiTokenPrefix) {
+		return nil, ErrInvalidToken
+	}
+
+	var token APITokens
+	err := tm.db.Collection(tm.Table()).Find(upperDB.Cond{"token_hash": hashToken(plain)}).One(&token)
+	if err != nil {
+		if errors.Is(err, upperDB.ErrNoMoreRows) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	var user Users
+	err = tm.db.Collection("users").Find(upperDB.Cond{"id": token.UserID}).One(&user)
+	if err != nil {
+		if errors.Is(err, upperDB.ErrNoMoreRows) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	if user.IsBanned() {
+		return nil, ErrUserBanned
+	}
+	if !user.Activated {
+		return nil, ErrUserNotActive
+	}
+
+	// only touch the row once a minute so busy scripts don't write on every request
+	_, err = tm.db.SQL().Exec(`UPDATE api_tokens SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`, token.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// HasScope ...
+func (t *APITokens) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// GetHumanLastUsed gives the last use like "10 minutes ago"
+func (t *APITokens) GetHumanLastUsed() string {
+	if t.LastUsedAt == nil {
+		return "never"
+	}
+	return carbon.CreateFromStdTime(*t.LastUsedAt).DiffForHumans()
+}
+
+func validScope(scope string) bool {
+	for _, s := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// generateToken returns 160 random bits encoded as base32
+func generateToken() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)), nil
+}
+
+func hashToken(plain string) []byte {
+	hash := sha256.Sum256([]byte(plain))
+	return hash[:]
+}
+
+// signToken is hashToken keyed with the application secret, used for the
+// short lived tokens that are sent by email
+func signToken(secret []byte, plain string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(plain))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,280 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"webapp/totp"
+
+	upperDB "github.com/upper/db/v4"
+)
+
+const (
+	// recoveryCodeCount is how many recovery codes a user gets at a time
+	recoveryCodeCount = 10
+	// maxTwoFactorAttempts is how many codes can be entered for an account
+	// without one being accepted, after that it has to wait for
+	// twoFactorAttemptWindow since the last one
+	maxTwoFactorAttempts   = 5
+	twoFactorAttemptWindow = 15 * time.Minute
+)
+
+var (
+	// ErrInvalidTwoFactorCode ...
+	ErrInvalidTwoFactorCode = errors.New("Invalid two-factor authentication code")
+	// ErrTwoFactorRequired ...
+	ErrTwoFactorRequired = errors.New("A two-factor authentication code is required")
+	// ErrTwoFactorEnabled ...
+	ErrTwoFactorEnabled = errors.New("Two-factor authentication is already turned on")
+	// ErrTwoFactorDisabled ...
+	ErrTwoFactorDisabled = errors.New("Two-factor authentication is turned off")
+	// ErrTooManyTwoFactorCodes ...
+	ErrTooManyTwoFactorCodes = errors.New("Too many invalid two-factor authentication codes, please try again later")
+)
+
+// TwoFactorModel manages the TOTP secrets of the users and their recovery
+// codes, which are signed like the emailed tokens
+type TwoFactorModel struct {
+	db     upperDB.Session
+	secret []byte
+}
+
+// Setup returns the TOTP secret the user adds to their authenticator app. A
+// new secret is only generated the first time, so reloading the setup page
+// doesn't invalidate an app that already scanned it.
+func (tm TwoFactorModel) Setup(userID int) (string, error) {
+	user, err := tm.user(tm.db, userID)
+	if err != nil {
+		return "", err
+	}
+	if user.HasTwoFactor() {
+		return "", ErrTwoFactorEnabled
+	}
+	if user.TOTPSecret != "" {
+		return user.TOTPSecret, nil
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return "", err
+	}
+	err = tm.db.Collection("users").Find(upperDB.Cond{"id": userID, "totp_enabled_at IS": nil}).
+		Update(upperDB.Cond{"totp_secret": secret})
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Enable turns two-factor authentication on once code shows the app of the
+// user was set up with the secret from Setup. It returns the recovery codes
+// of the user.
+func (tm TwoFactorModel) Enable(userID int, code string) ([]string, error) {
+	var codes []string
+	err := tm.db.Tx(func(tx upperDB.Session) error {
+		user, err := tm.user(tx, userID)
+		if err != nil {
+			return err
+		}
+		if user.HasTwoFactor() {
+			return ErrTwoFactorEnabled
+		}
+		if user.TOTPSecret == "" {
+			return ErrInvalidTwoFactorCode
+		}
+		step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+		if !ok {
+			return ErrInvalidTwoFactorCode
+		}
+
+		err = tx.Collection("users").Find(upperDB.Cond{"id": userID}).
+			Update(upperDB.Cond{"totp_enabled_at": time.Now(), "totp_last_step": step})
+		if err != nil {
+			return err
+		}
+		codes, err = tm.replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Verify checks the second factor of a user logging in, which is either a
+// code of their app or one of their recovery codes. A code only works once.
+// It reports whether a recovery code was used. Once maxTwoFactorAttempts
+// codes were refused in a row it fails with ErrTooManyTwoFactorCodes,
+// without checking the code.
+func (tm TwoFactorModel) Verify(userID int, code string) (bool, error) {
+	if err := tm.countAttempt(userID); err != nil {
+		return false, err
+	}
+	usedRecoveryCode, err := tm.verify(userID, code)
+	if err != nil {
+		return false, err
+	}
+	_, err = tm.db.SQL().Exec(`UPDATE users SET totp_attempts = 0 WHERE id = $1`, userID)
+	if err != nil {
+		return false, err
+	}
+	return usedRecoveryCode, nil
+}
+
+// countAttempt counts a code entered for the user before it is checked, so
+// concurrent requests can't try more codes than allowed
+func (tm TwoFactorModel) countAttempt(userID int) error {
+	res, err := tm.db.SQL().Exec(`UPDATE users SET
+			totp_attempts = CASE WHEN totp_attempted_at < $2 THEN 1 ELSE totp_attempts + 1 END,
+			totp_attempted_at = NOW()
+		WHERE id = $1 AND (totp_attempts < $3 OR totp_attempted_at < $2)`,
+		userID, time.Now().Add(-twoFactorAttemptWindow), maxTwoFactorAttempts)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(res); err != nil {
+		if errors.Is(err, ErrNoMoreRows) {
+			return ErrTooManyTwoFactorCodes
+		}
+		return err
+	}
+	return nil
+}
+
+func (tm TwoFactorModel) verify(userID int, code string) (bool, error) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) == totp.Digits {
+		return false, tm.verifyTOTP(userID, code)
+	}
+
+	res, err := tm.db.SQL().Exec(`UPDATE recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, signToken(tm.secret, normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	if err := requireAffected(res); err != nil {
+		if errors.Is(err, ErrNoMoreRows) {
+			return false, ErrInvalidTwoFactorCode
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (tm TwoFactorModel) verifyTOTP(userID int, code string) error {
+	user, err := tm.user(tm.db, userID)
+	if err != nil {
+		return err
+	}
+	if !user.HasTwoFactor() {
+		return ErrTwoFactorDisabled
+	}
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return ErrInvalidTwoFactorCode
+	}
+
+	// the step only moves forward, a replayed code matches no row
+	res, err := tm.db.SQL().Exec(`UPDATE users SET totp_last_step = $1
+		WHERE id = $2 AND totp_last_step < $1`, step, userID)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(res); err != nil {
+		if errors.Is(err, ErrNoMoreRows) {
+			return ErrInvalidTwoFactorCode
+		}
+		return err
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user with new
+// ones
+func (tm TwoFactorModel) RegenerateRecoveryCodes(userID int) ([]string, error) {
+	var codes []string
+	err := tm.db.Tx(func(tx upperDB.Session) error {
+		user, err := tm.user(tx, userID)
+		if err != nil {
+			return err
+		}
+		if !user.HasTwoFactor() {
+			return ErrTwoFactorDisabled
+		}
+		codes, err = tm.replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RecoveryCodesLeft counts the recovery codes the user hasn't used yet
+func (tm TwoFactorModel) RecoveryCodesLeft(userID int) (int, error) {
+	n, err := tm.db.Collection("recovery_codes").Find(upperDB.Cond{"user_id": userID, "used_at IS": nil}).Count()
+	return int(n), err
+}
+
+// Disable turns two-factor authentication off and forgets the secret and
+// the recovery codes of the user. It fails with ErrNoMoreRows when there is
+// no such user.
+func (tm TwoFactorModel) Disable(userID int) error {
+	return tm.db.Tx(func(tx upperDB.Session) error {
+		res, err := tx.SQL().Exec(`UPDATE users SET totp_secret = '', totp_enabled_at = NULL, totp_last_step = 0, totp_attempts = 0
+			WHERE id = $1`, userID)
+		if err != nil {
+			return err
+		}
+		if err := requireAffected(res); err != nil {
+			return err
+		}
+		return tx.Collection("recovery_codes").Find(upperDB.Cond{"user_id": userID}).Delete()
+	})
+}
+
+func (tm TwoFactorModel) user(sess upperDB.Session, userID int) (*Users, error) {
+	var user Users
+	err := sess.Collection("users").Find(upperDB.Cond{"id": userID}).One(&user)
+	if err != nil {
+		if errors.Is(err, upperDB.ErrNoMoreRows) {
+			return nil, ErrNoMoreRows
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// replaceRecoveryCodes deletes the recovery codes of the user and returns
+// recoveryCodeCount new ones, formatted like "abcde-fghij"
+func (tm TwoFactorModel) replaceRecoveryCodes(tx upperDB.Session, userID int) ([]string, error) {
+	col := tx.Collection("recovery_codes")
+	if err := col.Find(upperDB.Cond{"user_id": userID}).Delete(); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		plain, err := generateToken()
+		if err != nil {
+			return nil, err
+		}
+		plain = plain[:10]
+		_, err = col.Insert(map[string]interface{}{
+			"user_id":   userID,
+			"code_hash": signToken(tm.secret, plain),
+		})
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, plain[:5]+"-"+plain[5:])
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode undoes the formatting of a recovery code and what
+// users may add when typing it
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
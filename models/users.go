@@ -2,6 +2,9 @@ package models
 
 import (
 	"errors"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	upperDB "github.com/upper/db/v4"
@@ -9,8 +12,9 @@ import (
 )
 
 const (
-	passwordCost    = 12
-	usersEmailIndex = "users_email_key"
+	passwordCost       = 12
+	usersEmailIndex    = "users_email_key"
+	usersUsernameIndex = "users_username_key"
 )
 
 var (
@@ -18,12 +22,38 @@ var (
 	ErrNoMoreRows = errors.New("No record found")
 	// ErrDuplicateEmail ...
 	ErrDuplicateEmail = errors.New("Email already exists")
+	// ErrDuplicateUsername ...
+	ErrDuplicateUsername = errors.New("Username is already taken")
 	// ErrUserNotActive ...
 	ErrUserNotActive = errors.New("User account is inactive")
 	// ErrInvalidLogin ...
 	ErrInvalidLogin = errors.New("Invalid login")
+	// ErrUserBanned ...
+	ErrUserBanned = errors.New("User account is banned")
+	// ErrWrongPassword ...
+	ErrWrongPassword = errors.New("The current password is incorrect")
+	// ErrUsernameCooldown ...
+	ErrUsernameCooldown = errors.New("You changed your username recently, please wait before changing it again")
+	// ErrInvalidRole ...
+	ErrInvalidRole = errors.New("Role must be user, moderator or admin")
 )
 
+// Roles of the users, from the least to the most privileged
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// roleRanks orders the roles, a role may do everything the roles below it can
+var roleRanks = map[string]int{RoleUser: 1, RoleModerator: 2, RoleAdmin: 3}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
 // UsersModel ...
 type UsersModel struct {
 	db upperDB.Session
@@ -31,12 +61,62 @@ type UsersModel struct {
 
 // Users is the users table in postgres
 type Users struct {
-	ID        int       `db:"id,omitempty"`
-	Username  string    `db:"username"`
-	Password  string    `db:"password_hash"`
-	Email     string    `db:"email"`
-	Activated bool      `db:"activated"`
-	CreatedAt time.Time `db:"created_at"`
+	ID        int       `db:"id,omitempty" json:"id"`
+	Username  string    `db:"username" json:"username"`
+	Password  string    `db:"password_hash" json:"-"`
+	Email     string    `db:"email" json:"email,omitempty"`
+	Activated bool      `db:"activated" json:"-"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	// SessionVersion is stored in the session at login, sessions holding an
+	// older version are signed out
+	SessionVersion int `db:"session_version" json:"-"`
+	// Role is one of RoleUser, RoleModerator and RoleAdmin
+	Role string `db:"role,omitempty" json:"role,omitempty"`
+	// BannedAt is set while the user is banned, see Ban
+	BannedAt  *time.Time `db:"banned_at,omitempty" json:"-"`
+	BanReason string     `db:"ban_reason,omitempty" json:"-"`
+	// About is the free text of the public profile
+	About string `db:"about" json:"about,omitempty"`
+	// UsernameChangedAt is when the user last changed their username
+	UsernameChangedAt *time.Time `db:"username_changed_at,omitempty" json:"-"`
+	// TOTPSecret is the secret of the authenticator app of the user, it is
+	// only asked for at login once TwoFactorEnabledAt is set, see
+	// TwoFactorModel
+	TOTPSecret         string     `db:"totp_secret" json:"-"`
+	TwoFactorEnabledAt *time.Time `db:"totp_enabled_at,omitempty" json:"-"`
+}
+
+// IsBanned ...
+func (u *Users) IsBanned() bool {
+	return u.BannedAt != nil
+}
+
+// HasTwoFactor reports whether the user logs in with a second factor
+func (u *Users) HasTwoFactor() bool {
+	return u.TwoFactorEnabledAt != nil
+}
+
+// NextUsernameChange is when the user may change their username again, it
+// is the zero time when they may change it now
+func (u *Users) NextUsernameChange(cooldown time.Duration) time.Time {
+	if u.UsernameChangedAt == nil {
+		return time.Time{}
+	}
+	next := u.UsernameChangedAt.Add(cooldown)
+	if next.Before(time.Now()) {
+		return time.Time{}
+	}
+	return next
+}
+
+// ProfileURL is the path of the public profile of the user
+func (u *Users) ProfileURL() string {
+	return profileURL(u.Username)
+}
+
+// HasRole reports whether the user has role or a more privileged one
+func (u *Users) HasRole(role string) bool {
+	return roleRanks[u.Role] >= roleRanks[role] && ValidRole(role)
 }
 
 // Table returns the table names
@@ -49,6 +129,9 @@ func (um UsersModel) GetByID(id int) (*Users, error) {
 	var user Users
 	err := um.db.Collection(um.Table()).Find(upperDB.Cond{"id": id}).One(&user)
 	if err != nil {
+		if errors.Is(err, upperDB.ErrNoMoreRows) {
+			return nil, ErrNoMoreRows
+		}
 		return nil, err
 	}
 	return &user, nil
@@ -59,11 +142,139 @@ func (um UsersModel) GetByEmail(email string) (*Users, error) {
 	var user Users
 	err := um.db.Collection(um.Table()).Find(upperDB.Cond{"email": email}).One(&user)
 	if err != nil {
+		if errors.Is(err, upperDB.ErrNoMoreRows) {
+			return nil, ErrNoMoreRows
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetByUsername finds a user by their username, ignoring case like the
+// unique index does
+func (um UsersModel) GetByUsername(username string) (*Users, error) {
+	var user Users
+	err := um.db.Collection(um.Table()).Find("lower(username) = lower(?)", username).One(&user)
+	if err != nil {
+		if errors.Is(err, upperDB.ErrNoMoreRows) {
+			return nil, ErrNoMoreRows
+		}
 		return nil, err
 	}
 	return &user, nil
 }
 
+// SetRole gives the user a role
+func (um UsersModel) SetRole(id int, role string) error {
+	if !ValidRole(role) {
+		return ErrInvalidRole
+	}
+	return um.update(id, upperDB.Cond{"role": role})
+}
+
+// SetActivated activates or deactivates the account of a user
+func (um UsersModel) SetActivated(id int, activated bool) error {
+	return um.update(id, upperDB.Cond{"activated": activated})
+}
+
+// Ban keeps a user from logging in, their current sessions and API tokens
+// stop working too
+func (um UsersModel) Ban(id int, reason string) error {
+	return um.update(id, upperDB.Cond{"banned_at": time.Now(), "ban_reason": reason})
+}
+
+// Unban lifts the ban of a user
+func (um UsersModel) Unban(id int) error {
+	return um.update(id, upperDB.Cond{"banned_at": nil, "ban_reason": ""})
+}
+
+// SetAbout changes the about text of the profile of a user
+func (um UsersModel) SetAbout(id int, about string) error {
+	return um.update(id, upperDB.Cond{"about": about})
+}
+
+// CheckPassword confirms the password of a user before a sensitive change,
+// it fails with ErrWrongPassword when it doesn't match
+func (um UsersModel) CheckPassword(id int, password string) (*Users, error) {
+	user, err := um.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	match, err := user.comparePassword(password)
+	if err != nil {
+		return nil, err
+	}
+	if !match {
+		return nil, ErrWrongPassword
+	}
+	return user, nil
+}
+
+// SetPassword sets a new password, once the caller checked the current one
+// with CheckPassword. The session version is bumped so the other sessions of
+// the user are signed out, the updated user is returned to refresh the
+// current session.
+func (um UsersModel) SetPassword(id int, password string) (*Users, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return nil, err
+	}
+	_, err = um.db.SQL().Exec(`UPDATE users SET password_hash = $1, session_version = session_version + 1
+		WHERE id = $2`, hash, id)
+	if err != nil {
+		return nil, err
+	}
+	return um.GetByID(id)
+}
+
+// ChangeUsername renames a user, unless they already did within cooldown
+func (um UsersModel) ChangeUsername(id int, username string, cooldown time.Duration) error {
+	user, err := um.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if !user.NextUsernameChange(cooldown).IsZero() {
+		return ErrUsernameCooldown
+	}
+	err = um.update(id, upperDB.Cond{"username": username, "username_changed_at": time.Now()})
+	if err != nil && errHasDuplicate(err, usersUsernameIndex) {
+		return ErrDuplicateUsername
+	}
+	return err
+}
+
+// update sets the columns of a user, it fails with ErrNoMoreRows when there
+// is no such user
+func (um UsersModel) update(id int, set upperDB.Cond) error {
+	res := um.db.Collection(um.Table()).Find(upperDB.Cond{"id": id})
+	exists, err := res.Exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNoMoreRows
+	}
+	return res.Update(set)
+}
+
+// Karma is the score of the posts and comments of a user, not counting
+// their own votes
+func (um UsersModel) Karma(userID int) (int, error) {
+	var karma int
+	row, err := um.db.SQL().QueryRow(`SELECT
+		COALESCE((SELECT SUM(v.value) FROM votes v JOIN posts p ON p.id = v.post_id
+			WHERE p.user_id = $1 AND v.user_id <> $1), 0) +
+		COALESCE((SELECT SUM(v.value) FROM comment_votes v JOIN comments c ON c.id = v.comment_id
+			WHERE c.user_id = $1 AND v.user_id <> $1), 0)`, userID)
+	if err != nil {
+		return 0, err
+	}
+	if err := row.Scan(&karma); err != nil {
+		return 0, err
+	}
+	return karma, nil
+}
+
 // Insert ...
 func (um UsersModel) Insert(user *Users) error {
 	newhash, err := bcrypt.GenerateFromPassword([]byte(user.Password), passwordCost)
@@ -72,12 +283,17 @@ func (um UsersModel) Insert(user *Users) error {
 	}
 	user.Password = string(newhash)
 	user.CreatedAt = time.Now()
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
 	col := um.db.Collection(um.Table())
 	res, err := col.Insert(user)
 	if err != nil {
 		switch {
 		case errHasDuplicate(err, usersEmailIndex):
 			return ErrDuplicateEmail
+		case errHasDuplicate(err, usersUsernameIndex):
+			return ErrDuplicateUsername
 		default:
 			return err
 		}
@@ -100,14 +316,24 @@ func (u *Users) comparePassword(plainPassword string) (bool, error) {
 	return true, nil
 }
 
-// AuthenticateUser logs in the user
-func (um *UsersModel) AuthenticateUser(email, password string) (*Users, error) {
-	user, err := um.GetByEmail(email)
-	if err != nil {
-		return nil, err
+// FindByLogin finds the user logging in, login is either their email or
+// their username
+func (um UsersModel) FindByLogin(login string) (*Users, error) {
+	if strings.Contains(login, "@") {
+		return um.GetByEmail(login)
 	}
-	if !user.Activated {
-		return nil, ErrUserNotActive
+	return um.GetByUsername(login)
+}
+
+// AuthenticateUser checks the password of the user found by FindByLogin.
+// user is nil for a login matching no account, which is rejected with
+// ErrInvalidLogin only after hashing password too, so the response time
+// doesn't tell which accounts exist. For the same reason inactive and
+// banned accounts are only reported once the password matched.
+func (um *UsersModel) AuthenticateUser(user *Users, password string) (*Users, error) {
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return nil, ErrInvalidLogin
 	}
 	match, err := user.comparePassword(password)
 	if err != nil {
@@ -116,5 +342,30 @@ func (um *UsersModel) AuthenticateUser(email, password string) (*Users, error) {
 	if !match {
 		return nil, ErrInvalidLogin
 	}
+	if !user.Activated {
+		return nil, ErrUserNotActive
+	}
+	if user.IsBanned() {
+		return nil, ErrUserBanned
+	}
 	return user, nil
 }
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// dummyPasswordHash is a hash of the same cost as the real ones, to compare
+// the passwords of unknown logins against
+func dummyPasswordHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not the password of anyone"), passwordCost)
+	})
+	return dummyHash
+}
+
+// profileURL is the path of the public profile of a username
+func profileURL(username string) string {
+	return "/user/" + url.PathEscape(username)
+}
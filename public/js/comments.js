@@ -0,0 +1,26 @@
+// Collapses and expands comment threads. Comments are rendered as a flat list
+// in tree order, so the replies of a comment are the following siblings with
+// a greater depth.
+document.querySelectorAll(".comment__toggle").forEach(function (btn) {
+    btn.addEventListener("click", function () {
+        var comment = btn.closest(".comment");
+        var depth = parseInt(comment.dataset.depth, 10);
+        var collapsed = comment.classList.toggle("comment--collapsed");
+        btn.textContent = collapsed ? "[+]" : "[-]";
+
+        for (var next = comment.nextElementSibling; next; next = next.nextElementSibling) {
+            if (parseInt(next.dataset.depth, 10) <= depth) {
+                break;
+            }
+            next.hidden = collapsed;
+            if (!collapsed) {
+                // expanding a thread also unfolds the replies that were collapsed inside it
+                next.classList.remove("comment--collapsed");
+                var childBtn = next.querySelector(".comment__toggle");
+                if (childBtn) {
+                    childBtn.textContent = "[-]";
+                }
+            }
+        }
+    });
+});
@@ -0,0 +1,28 @@
+// Submits the vote arrows in the background and swaps in the updated vote
+// box, so voting doesn't reload the page. Without javascript the forms post
+// normally and the server redirects back.
+document.addEventListener("submit", function (event) {
+    var form = event.target;
+    if (!form.classList || !form.classList.contains("vote-form")) {
+        return;
+    }
+    event.preventDefault();
+
+    fetch(form.action, {
+        method: "POST",
+        body: new URLSearchParams(new FormData(form)),
+        headers: { "X-Requested-With": "fetch" },
+        credentials: "same-origin",
+    }).then(function (res) {
+        if (!res.ok || res.redirected) {
+            // e.g. logged out or not enough karma, let the server explain
+            form.submit();
+            return;
+        }
+        return res.text().then(function (html) {
+            form.closest("[data-vote]").outerHTML = html;
+        });
+    }).catch(function () {
+        form.submit();
+    });
+});